@@ -1,8 +1,12 @@
 package fliptest_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"os/signal"
+	"time"
 
 	"github.com/GESkunkworks/fliptest"
 	"github.com/aws/aws-sdk-go/aws"
@@ -85,3 +89,537 @@ func ExampleNew_newstack() {
 		fmt.Println(test.GetLog())
 	}
 }
+
+// flip-nat-gateway
+//
+// This example tests the current egress path, points the
+// default route at a new NAT gateway, tests again and
+// rolls the route back if anything regressed.
+func ExampleNewRouteFlipper() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.RouteFlipInput{
+		TesterInput: &fliptest.FlipTesterInput{
+			Session:  sess,
+			SubnetId: "subnet-d3297188",
+			VpcId:    "vpc-c8a6c3ae",
+		},
+		RouteTableId: "rtb-0e5a8d7f1c2b3a4d5",
+		NewTarget: &fliptest.RouteTarget{
+			NatGatewayId: "nat-0a1b2c3d4e5f67890",
+		},
+	}
+	flipper, err := fliptest.NewRouteFlipper(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = flipper.Flip()
+	if err != nil {
+		fmt.Println(err)
+	}
+	// the full before and after record is always available
+	if body, err := json.MarshalIndent(flipper.Result, "", "    "); err == nil {
+		fmt.Println(string(body))
+	}
+}
+
+// nat-drill
+//
+// This example fails a subnet over to every other AZ's
+// NAT gateway in turn and makes sure the original routes
+// are restored if the process is interrupted.
+func ExampleNewNatDrill() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.NatDrillInput{
+		TesterInput: &fliptest.FlipTesterInput{
+			Session: sess,
+			VpcId:   "vpc-c8a6c3ae",
+		},
+		SubnetIds: []string{"subnet-d3297188", "subnet-a1b2c3d4"},
+	}
+	drill, err := fliptest.NewNatDrill(&input)
+	if err != nil {
+		panic(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = drill.RunWithContext(ctx)
+	if err != nil {
+		fmt.Println(err)
+	}
+	for _, report := range drill.Reports {
+		fmt.Printf("%s -> %s: passed=%t restored=%t delta=%.2fs\n",
+			report.SubnetAvailabilityZone, report.DrillNatAvailabilityZone,
+			report.DrillPassed, report.Restored, report.ElapsedTimeDeltaS,
+		)
+	}
+}
+
+// subnet-matrix
+//
+// This example tests every subnet in a VPC tagged as
+// private and prints a subnet by test result matrix.
+func ExampleNewMatrix() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.FlipTesterInput{
+		Session:    sess,
+		VpcId:      "vpc-c8a6c3ae",
+		SubnetTags: map[string]string{"Tier": "private"},
+	}
+	matrix, err := fliptest.NewMatrix(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = matrix.Test()
+	if err != nil {
+		fmt.Println(err)
+	}
+	for _, subnetId := range matrix.Matrix.SubnetIds {
+		for _, name := range matrix.Matrix.TestNames {
+			if result := matrix.Matrix.Get(subnetId, name); result != nil {
+				fmt.Printf("%s %s %t\n", subnetId, name, result.Success)
+			}
+		}
+	}
+}
+
+// multi-account
+//
+// This example tests VPCs in two accounts by assuming a
+// role in each from the same base session.
+func ExampleNewRunner() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.RunnerInput{
+		Session: sess,
+		Targets: []*fliptest.Target{
+			{
+				Context: "account1",
+				RoleArn: "arn:aws:iam::111111111111:role/fliptest",
+				Region:  "us-east-1",
+				VpcId:   "vpc-c8a6c3ae",
+			},
+			{
+				Context:   "account2",
+				RoleArn:   "arn:aws:iam::222222222222:role/fliptest",
+				Region:    "eu-west-1",
+				VpcId:     "vpc-0f1e2d3c4b5a69788",
+				SubnetIds: []string{"subnet-0123456789abcdef0"},
+			},
+		},
+		MaxConcurrency: 2,
+	}
+	runner, err := fliptest.NewRunner(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = runner.Run()
+	if err != nil {
+		fmt.Println(err)
+	}
+	if body, err := json.MarshalIndent(runner.Report, "", "    "); err == nil {
+		fmt.Println(string(body))
+	}
+}
+
+// organization
+//
+// This example discovers every production VPC in an
+// organizational unit and tests them all.
+func ExampleDiscover() {
+	sess := session.Must(session.NewSession())
+	targets, err := fliptest.Discover(&fliptest.DiscoverInput{
+		Session:              sess,
+		OrganizationalUnitId: "ou-ab12-34cd56ef",
+		Regions:              []string{"us-east-1", "us-west-2"},
+		VpcTags:              map[string]string{"Environment": "prod"},
+	})
+	if err != nil {
+		// some accounts couldn't be searched but the
+		// targets that were found can still be tested
+		fmt.Println(err)
+	}
+	runner, err := fliptest.NewRunner(&fliptest.RunnerInput{
+		Session: sess,
+		Targets: targets,
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = runner.Run()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// list-stacks
+//
+// This example finds a retained stack for a subnet
+// and resumes it instead of creating a new one.
+func ExampleList() {
+	sess := session.Must(session.NewSession())
+	stacks, err := fliptest.List(&fliptest.ListInput{Session: sess})
+	if err != nil {
+		panic(err)
+	}
+	for _, stack := range stacks {
+		if stack.SubnetId != "subnet-d3297188" || stack.StackStatus != "CREATE_COMPLETE" {
+			continue
+		}
+		test, err := fliptest.New(&fliptest.FlipTesterInput{
+			Session:     sess,
+			StackName:   stack.StackName,
+			RetainStack: true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		err = test.Test()
+		if err != nil {
+			fmt.Println(err)
+		}
+		break
+	}
+}
+
+// sweep-stacks
+//
+// This example reports which stacks are failed or more
+// than a day old without deleting anything.
+func ExampleSweep() {
+	sess := session.Must(session.NewSession())
+	swept, err := fliptest.Sweep(&fliptest.SweepInput{
+		Session: sess,
+		MaxAge:  24 * time.Hour,
+		DryRun:  true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, s := range swept {
+		fmt.Printf("would delete %s (%s)\n", s.Stack.StackName, s.Reason)
+	}
+}
+
+// shared-stack
+//
+// This example lets parallel CI jobs testing the same
+// subnet share one stack that expires on its own.
+func ExampleNew_reusestack() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.FlipTesterInput{
+		Session:       sess,
+		SubnetId:      "subnet-d3297188",
+		VpcId:         "vpc-c8a6c3ae",
+		ReuseStack:    true,
+		StackTTLHours: 12,
+	}
+	test, err := fliptest.New(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = test.Test()
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("used stack %s which expires at %s\n", test.StackName, test.ExpiresAt)
+}
+
+// upgrade-stack
+//
+// This example checks whether a retained stack was created
+// from an older template and upgrades it after showing the
+// planned changes.
+func ExampleFlipTester_PlanUpgrade() {
+	sess := session.Must(session.NewSession())
+	test, err := fliptest.New(&fliptest.FlipTesterInput{
+		Session:   sess,
+		StackName: "ISS-GR-egress-tester-00714632",
+	})
+	if err != nil {
+		panic(err)
+	}
+	version, outdated, err := test.CheckStackVersion()
+	if err != nil {
+		panic(err)
+	}
+	if !outdated {
+		fmt.Printf("stack is on template version %s\n", version)
+		return
+	}
+	upgrade, err := test.PlanUpgrade()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(upgrade)
+	err = test.ExecuteUpgrade(upgrade)
+	if err != nil {
+		fmt.Println(test.GetLog())
+		panic(err)
+	}
+}
+
+// tagged-stack
+//
+// This example adds the tags that an SCP requires on every
+// resource and then lists the stacks from the same run.
+func ExampleNew_tags() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.FlipTesterInput{
+		Session:  sess,
+		SubnetId: "subnet-d3297188",
+		VpcId:    "vpc-c8a6c3ae",
+		Tags: map[string]string{
+			"CostCenter":  "12345",
+			"Owner":       "network-team@example.com",
+			"Application": "egress-testing",
+		},
+		RetainStack: true,
+	}
+	test, err := fliptest.New(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = test.Test()
+	if err != nil {
+		fmt.Println(err)
+	}
+	stacks, err := fliptest.List(&fliptest.ListInput{
+		Session: sess,
+		Tags:    map[string]string{"fliptest:run-id": test.RunId},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, stack := range stacks {
+		fmt.Println(stack.StackName)
+	}
+}
+
+// custom-template
+//
+// This example creates a stack from a custom template that
+// takes an extra parameter and exports its log group name.
+func ExampleNew_customtemplate() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.FlipTesterInput{
+		Session:               sess,
+		SubnetId:              "subnet-d3297188",
+		VpcId:                 "vpc-c8a6c3ae",
+		StackTemplateFilename: "fliptest-custom.yml",
+		StackParameters: map[string]string{
+			"LogRetentionDays": "7",
+		},
+	}
+	test, err := fliptest.New(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = test.Test()
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("logs are in %s\n", test.StackOutputs["LogGroupName"])
+}
+
+// plan
+//
+// This example prints what .Test() would do in a
+// production account without changing anything.
+func ExampleFlipTester_Plan() {
+	sess := session.Must(session.NewSession())
+	test, err := fliptest.New(&fliptest.FlipTesterInput{
+		Session:  sess,
+		SubnetId: "subnet-d3297188",
+		VpcId:    "vpc-c8a6c3ae",
+	})
+	if err != nil {
+		panic(err)
+	}
+	plan, err := test.Plan()
+	if plan != nil {
+		fmt.Println(plan)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// preflight
+//
+// This example lists any IAM permissions the caller is
+// missing before committing to a stack creation.
+func ExampleFlipTester_Preflight() {
+	sess := session.Must(session.NewSession())
+	test, err := fliptest.New(&fliptest.FlipTesterInput{
+		Session:       sess,
+		SubnetId:      "subnet-d3297188",
+		VpcId:         "vpc-c8a6c3ae",
+		StackTTLHours: 4,
+	})
+	if err != nil {
+		panic(err)
+	}
+	missing, err := test.Preflight()
+	if err != nil && len(missing) < 1 {
+		panic(err)
+	}
+	for _, m := range missing {
+		fmt.Println("missing:", m)
+	}
+}
+
+// existing-role
+//
+// This example uses an existing execution role in an
+// account that doesn't allow roles to be created.
+func ExampleNew_existingrole() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.FlipTesterInput{
+		Session:          sess,
+		SubnetId:         "subnet-d3297188",
+		VpcId:            "vpc-c8a6c3ae",
+		ExecutionRoleArn: "arn:aws:iam::123456789012:role/approved/fliptest-lambda",
+	}
+	test, err := fliptest.New(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = test.Test()
+	if err != nil {
+		fmt.Println(test.GetLog())
+		panic(err)
+	}
+}
+
+// application-security-group
+//
+// This example tests whether an application's security
+// group allows egress to its dependencies from a subnet.
+func ExampleNew_securitygroups() {
+	sess := session.Must(session.NewSession())
+	input := fliptest.FlipTesterInput{
+		Session:                       sess,
+		SubnetId:                      "subnet-d3297188",
+		VpcId:                         "vpc-c8a6c3ae",
+		SecurityGroupIds:              []string{"sg-0a1b2c3d4e5f60718"},
+		ExcludeGeneratedSecurityGroup: true,
+		TestUrls: []*fliptest.TestUrl{
+			{
+				Name: "payments-api",
+				Url:  "https://api.payments.example.com/health",
+			},
+		},
+	}
+	test, err := fliptest.New(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = test.Test()
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("passed: %t\n", test.Passed)
+}
+
+// lambda-settings
+//
+// This example runs a large suite on an arm64 lambda with
+// a longer timeout, sending the tests through a proxy.
+func ExampleNew_lambdasettings() {
+	sess := session.Must(session.NewSession())
+	var tests []*fliptest.TestUrl
+	for _, host := range []string{"github.com", "pypi.org", "registry.npmjs.org", "proxy.golang.org"} {
+		tests = append(tests, &fliptest.TestUrl{Name: host, Url: "https://" + host})
+	}
+	input := fliptest.FlipTesterInput{
+		Session:        sess,
+		SubnetId:       "subnet-d3297188",
+		VpcId:          "vpc-c8a6c3ae",
+		TestUrls:       tests,
+		Architecture:   "arm64",
+		MemorySize:     256,
+		TimeoutSeconds: 120,
+		Environment: map[string]string{
+			"HTTPS_PROXY": "http://proxy.internal.example.com:3128",
+		},
+	}
+	test, err := fliptest.New(&input)
+	if err != nil {
+		panic(err)
+	}
+	err = test.Test()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// async
+//
+// This example starts a long suite asynchronously on a
+// retained stack and collects the results in a later
+// process using the stack name and run ID.
+func ExampleFlipTester_StartAsync() {
+	sess := session.Must(session.NewSession())
+	var tests []*fliptest.TestUrl
+	for i := 0; i < 200; i++ {
+		tests = append(tests, &fliptest.TestUrl{
+			Name: fmt.Sprintf("host-%d", i),
+			Url:  fmt.Sprintf("https://host-%d.internal.example.com", i),
+		})
+	}
+	test, err := fliptest.New(&fliptest.FlipTesterInput{
+		Session:     sess,
+		SubnetId:    "subnet-d3297188",
+		VpcId:       "vpc-c8a6c3ae",
+		TestUrls:    tests,
+		Async:       true,
+		RetainStack: true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = test.CreateStack()
+	if err != nil {
+		panic(err)
+	}
+	err = test.StartAsync()
+	if err != nil {
+		panic(err)
+	}
+
+	// later, possibly somewhere else
+	collector, err := fliptest.New(&fliptest.FlipTesterInput{
+		Session:   sess,
+		StackName: test.StackName,
+		RunId:     test.RunId,
+	})
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	err = collector.CollectResults(ctx)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("%d results, passed: %t\n", len(collector.TestResults), collector.Passed)
+}
+
+// info
+//
+// This example asks a retained stack's lambda where it
+// runs from without running any tests.
+func ExampleFlipTester_Info() {
+	sess := session.Must(session.NewSession())
+	test, err := fliptest.New(&fliptest.FlipTesterInput{
+		Session:   sess,
+		StackName: "fliptest-abc123",
+	})
+	if err != nil {
+		panic(err)
+	}
+	info, err := test.Info()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(info.PrivateIp, info.AvailabilityZone, info.Resolvers)
+}
@@ -5,26 +5,67 @@ package fliptest
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 )
 
 // Unless overridden using FlipTesterInput the stack will
 // be prefixed with this and a random number will be added to the end.
 const DefaultStackPrefix string = "ISS-GR-egress-tester-"
 
+// The version of the embedded templates. Stacks created from
+// them are tagged with it so that retained stacks can be
+// told apart later.
+const TemplateVersion string = "15"
+
+// Tag keys that fliptest adds to the stacks it creates.
+const (
+	tagTemplateVersion string = "fliptest:template-version"
+	tagExpiresAt       string = "fliptest:expires-at"
+	tagVpcId           string = "fliptest:vpc-id"
+	tagSubnetId        string = "fliptest:subnet-id"
+	tagTool            string = "fliptest:tool"
+	tagRunId           string = "fliptest:run-id"
+	tagAsyncResults    string = "fliptest:async-results"
+	tagConfigHash      string = "fliptest:config-hash"
+)
+
+// Prefixes of tag keys that can't be set with
+// FlipTesterInput.Tags.
+var reservedTagPrefixes = []string{"fliptest:", "aws:"}
+
+// The longest a single test may take (in seconds) and
+// still be considered passing.
+const maxElapsedTimeS float64 = 6.0
+
+// The source of stack name suffixes and run IDs. It's the
+// package's own so that importers' use of math/rand is left
+// alone, and it's seeded once so that stacks created in
+// parallel don't end up with the same suffix.
+var (
+	randomMu sync.Mutex
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
 // FlipTesterInput provides all of the information necessary
 // to create a FlipTester object.
 type FlipTesterInput struct {
@@ -91,6 +132,205 @@ type FlipTesterInput struct {
 	// VPC lambdas need a little extra time.
 	// Default: 20 Seconds
 	PostEventSleepTimeSeconds int
+
+	// The SubnetIds in which to launch test lambdas
+	// when testing several subnets at once with
+	// NewMatrix. Ignored by New.
+	SubnetIds []string
+
+	// Whether or not NewMatrix should test every
+	// subnet in VpcId instead of SubnetIds.
+	AllSubnets bool
+
+	// Tags that a subnet in VpcId must have to be
+	// tested by NewMatrix. An empty value matches any
+	// value for that key. Setting SubnetTags implies
+	// AllSubnets.
+	SubnetTags map[string]string
+
+	// The maximum number of stacks that NewMatrix
+	// will create and test at the same time.
+	// Default: 10
+	MaxParallelStacks int
+
+	// Whether or not deleting the stack should block
+	// until the deletion is complete. Deleting a VPC
+	// lambda can take 20+ minutes while its ENIs are
+	// released. If the deletion fails the blocking
+	// resources are recorded and it is retried.
+	WaitForDelete bool
+
+	// How many times to retry a failed stack deletion
+	// when WaitForDelete is set.
+	// Default: 3
+	DeleteRetries int
+
+	// How many hours after creation the stack should
+	// delete itself. The stack gets a scheduled cleanup
+	// function so this happens even if this process
+	// dies, which makes it a safety net for retained
+	// stacks. The expiry is recorded in the stack's
+	// "fliptest:expires-at" tag. Only supported by the
+	// default template.
+	// Default: 0 (the stack never expires)
+	StackTTLHours int
+
+	// Whether or not to look for an existing healthy
+	// stack for the same VpcId, SubnetId, template
+	// version and configuration e.g. SecurityGroupIds,
+	// the role and lambda settings, whether StackTTLHours
+	// is set or a custom template's body and
+	// StackParameters (identified by the stack's tags)
+	// and use it instead of creating a new one. If
+	// none is found the new stack gets a name and
+	// ClientRequestToken derived from the same things so
+	// that parallel jobs end up sharing one stack. Since
+	// other jobs may be using the stack it is always
+	// retained.
+	ReuseStack bool
+
+	// Whether or not to upgrade the stack given by
+	// StackName in place if it was created from an older
+	// version of the template. The upgrade is done with a
+	// change set whose diff is logged before it's executed.
+	// Without this an outdated stack only logs a warning.
+	// StackTemplateFilename should be provided as well if
+	// the stack was created from a custom template.
+	UpgradeStack bool
+
+	// Tags to add to the stack. Cloudformation copies
+	// them to the lambda, role and security group so
+	// this is how tag policies and SCPs that require
+	// tags on every resource are satisfied. Keys may
+	// not start with "fliptest:" or "aws:".
+	Tags map[string]string
+
+	// An identifier recorded in the stack's
+	// "fliptest:run-id" tag so stacks from the same
+	// run can be found later. NewMatrix and NewRunner
+	// give all of their stacks the same one.
+	// Default: a random ID
+	RunId string
+
+	// Values for any extra parameters declared by the
+	// StackTemplateFilename template, keyed by parameter
+	// name. SubnetId and VpcId are always passed and
+	// can't be set here.
+	StackParameters map[string]string
+
+	// Whether or not .Test() should only work out what it
+	// would do, without creating, changing or deleting
+	// anything. The result is stored in .TestPlan.
+	DryRun bool
+
+	// Whether or not to check that the caller has the IAM
+	// permissions needed to create, call and delete the
+	// stack before creating it. Missing permissions are
+	// stored in .MissingPermissions and fail the test.
+	Preflight bool
+
+	// The ARN of an existing role for the test lambda to
+	// use instead of creating one. It needs the
+	// permissions of AWSLambdaVPCAccessExecutionRole.
+	// Self-expiring stacks still create a cleanup role.
+	// Only supported by the default template.
+	ExecutionRoleArn string
+
+	// The ARN of a managed policy to set as the permissions
+	// boundary of every role the stack creates. Only
+	// supported by the default template.
+	PermissionsBoundaryArn string
+
+	// The path of the roles the stack creates. Only
+	// supported by the default template.
+	// Default: "/cs/"
+	RolePath string
+
+	// A prefix for the names of the roles the stack
+	// creates. When set the roles are named after the
+	// prefix and the stack name instead of Cloudformation
+	// generating names. Only supported by the default
+	// template.
+	RoleNamePrefix string
+
+	// Existing security groups to attach to the test lambda
+	// so that the tests are subject to their egress rules,
+	// e.g. an application's security group. They must be
+	// in VpcId. Only supported by the default template.
+	SecurityGroupIds []string
+
+	// Whether or not to leave out the security group the
+	// stack creates, which allows all egress, so that only
+	// SecurityGroupIds apply to the tests.
+	ExcludeGeneratedSecurityGroup bool
+
+	// The memory (in MB) of the test lambda. Only
+	// supported by the default template.
+	// Default: 128
+	MemorySize int
+
+	// The timeout (in seconds) of the test lambda. Every
+	// test can take up to 4 seconds so large suites need
+	// more than the default. Only supported by the default
+	// template.
+	// Default: 30 Seconds
+	TimeoutSeconds int
+
+	// The instruction set architecture of the test lambda,
+	// "x86_64" or "arm64". Only supported by the default
+	// template.
+	// Default: "x86_64"
+	Architecture string
+
+	// The reserved concurrency of the test lambda. Only
+	// supported by the default template.
+	// Default: 0 (no reserved concurrency)
+	ReservedConcurrency int
+
+	// Environment variables for the test lambda to set
+	// before running the tests e.g. HTTPS_PROXY. They are
+	// passed as JSON in the FLIPTEST_ENVIRONMENT variable.
+	// Only supported by the default template.
+	Environment map[string]string
+
+	// The ARN of a KMS key to encrypt the test lambda's
+	// environment variables with. Only supported by the
+	// default template.
+	KmsKeyArn string
+
+	// The most test URLs to send to the lambda in one
+	// invocation. Larger suites are split into batches
+	// so that each invocation finishes within the
+	// lambda's timeout.
+	// Default: 5
+	BatchSize int
+
+	// The maximum number of batches to invoke the
+	// lambda with at the same time. It's lowered to
+	// ReservedConcurrency if that's smaller so that
+	// batches aren't throttled.
+	// Default: 5
+	MaxParallelInvokes int
+
+	// How many tests the lambda runs at the same time in
+	// each invocation. Each test is timed on its own so
+	// ElapsedTimeS isn't affected. Stacks created from
+	// template versions before 7 run tests one at a time.
+	// Default: 5
+	Workers int
+
+	// Whether or not to invoke the lambda asynchronously
+	// so that suites aren't limited by a single request.
+	// New stacks get a queue that the results are sent to
+	// and .Test() polls it for up to AsyncTimeoutMinutes.
+	// Use .StartAsync() and .CollectResults() to collect
+	// the results later instead. An ExecutionRoleArn role
+	// needs sqs:SendMessage on the queue.
+	Async bool
+
+	// How long .Test() waits for asynchronous results.
+	// Default: 30 Minutes
+	AsyncTimeoutMinutes int
 }
 
 // New returns an instance of FlipTester provided a prebuilt
@@ -109,8 +349,11 @@ func New(input *FlipTesterInput) (ft *FlipTester, err error) {
 		}
 	}
 	ft = &FlipTester{
-		sess:  input.Session,
-		cfSvc: cloudformation.New(input.Session),
+		sess:   input.Session,
+		cfSvc:  cloudformation.New(input.Session),
+		ec2Svc: ec2.New(input.Session),
+		iamSvc: iam.New(input.Session),
+		stsSvc: sts.New(input.Session),
 	}
 	if input.Context == "" {
 		input.Context = "Default"
@@ -142,35 +385,120 @@ func New(input *FlipTesterInput) (ft *FlipTester, err error) {
 			ft.stackPrefix = input.StackPrefix
 		}
 		ft.stackTemplateFilename = input.StackTemplateFilename
+		err = validateTags(input.Tags)
+		if err != nil {
+			return nil, err
+		}
+		ft.tags = input.Tags
+		if len(input.StackParameters) > 0 && input.StackTemplateFilename == "" {
+			err = errors.New("StackParameters can only be used with a StackTemplateFilename")
+			return nil, err
+		}
+		for key := range input.StackParameters {
+			if key == "SubnetId" || key == "VpcId" {
+				err = fmt.Errorf("stack parameter '%s' is set by fliptest", key)
+				return nil, err
+			}
+		}
+		ft.stackParameters = input.StackParameters
+		err = ft.setRoleOptions(input)
+		if err != nil {
+			return nil, err
+		}
+		err = ft.setSecurityGroupOptions(input)
+		if err != nil {
+			return nil, err
+		}
+		err = ft.setFunctionOptions(input)
+		if err != nil {
+			return nil, err
+		}
+		if input.StackTTLHours > 0 && input.StackTemplateFilename != "" {
+			err = errors.New("StackTTLHours is only supported by the default template")
+			return nil, err
+		}
 	} else {
 		msg := "using existing stack"
 		ft.logMessage(msg)
 		ft.StackName = input.StackName
 		ft.stackCreated = true
+		ft.stackTemplateFilename = input.StackTemplateFilename
+		ft.resumed = true
+	}
+	ft.RetainStack = input.RetainStack || input.ReuseStack
+	ft.reuseStack = input.ReuseStack
+	ft.waitForDelete = input.WaitForDelete
+	if input.DeleteRetries == 0 {
+		input.DeleteRetries = 3
+	}
+	ft.deleteRetries = input.DeleteRetries
+	ft.stackTTLHours = input.StackTTLHours
+	ft.upgradeStack = input.UpgradeStack
+	ft.dryRun = input.DryRun
+	ft.preflight = input.Preflight
+	if input.BatchSize == 0 {
+		input.BatchSize = 5
+	}
+	ft.batchSize = input.BatchSize
+	if input.MaxParallelInvokes == 0 {
+		input.MaxParallelInvokes = 5
+	}
+	ft.maxParallelInvokes = input.MaxParallelInvokes
+	if input.Workers == 0 {
+		input.Workers = 5
+	}
+	ft.async = input.Async
+	if input.AsyncTimeoutMinutes == 0 {
+		input.AsyncTimeoutMinutes = 30
+	}
+	ft.asyncTimeoutMinutes = input.AsyncTimeoutMinutes
+	if input.RunId == "" {
+		input.RunId = newRunId()
 	}
-	ft.RetainStack = input.RetainStack
+	ft.RunId = input.RunId
 	ft.testEvent = &lambdaEvent{
-		RequestType: "RunAll",
-		TestUrls:    input.TestUrls,
+		ProtocolVersion: ProtocolVersion,
+		RequestType:     "RunAll",
+		TestUrls:        input.TestUrls,
+		Workers:         input.Workers,
 	}
 	if len(input.TestUrls) < 1 {
 		// setup some defaults
-		ft.testEvent.TestUrls = append(ft.testEvent.TestUrls,
-			&TestUrl{
-				Name: "gopkg.in",
-				Url:  "https://gopkg.in",
-			},
-			&TestUrl{
-				Name: "google",
-				Url:  "https://www.google.com",
+		partition := partitionForRegion(aws.StringValue(input.Session.Config.Region))
+		ft.testEvent.TestUrls = defaultTestUrls(partition)
+	}
+	return ft, nil
+}
+
+// defaultTestUrls returns the tests to run when none are provided.
+// Regions in China can't reach the usual sites so they get their own.
+func defaultTestUrls(partition string) []*TestUrl {
+	if partition == endpoints.AwsCnPartitionID {
+		return []*TestUrl{
+			{
+				Name: "amazonaws.cn",
+				Url:  "https://www.amazonaws.cn",
 			},
-			&TestUrl{
-				Name: "time",
-				Url:  "https://www.nist.gov",
+			{
+				Name: "baidu",
+				Url:  "https://www.baidu.com",
 			},
-		)
+		}
+	}
+	return []*TestUrl{
+		{
+			Name: "gopkg.in",
+			Url:  "https://gopkg.in",
+		},
+		{
+			Name: "google",
+			Url:  "https://www.google.com",
+		},
+		{
+			Name: "time",
+			Url:  "https://www.nist.gov",
+		},
 	}
-	return ft, nil
 }
 
 // FlipTester is object that is created and its methods are called
@@ -190,17 +518,88 @@ type FlipTester struct {
 	TestResults []*TestResult
 	testEvent   *lambdaEvent
 
+	// Describes the lambda invocations that produced
+	// TestResults, one per batch in batch order. The
+	// entries for batches that failed are nil.
+	Metadata []*RunMetadata
+
 	// Indicates whether or not the tests passed. The pass
 	// criteria is fixed based on whether the GET request
 	// received a 200 response and it took less than 6 seconds
 	Passed bool
 	sess   *session.Session
 	cfSvc  cloudformationiface.CloudFormationAPI
+	ec2Svc ec2iface.EC2API
 
 	// Indicates whether or not the stack will be deleted after
 	// the .Test() method is called.
-	RetainStack  bool
-	stackCreated bool
+	RetainStack   bool
+	stackCreated  bool
+	waitForDelete bool // whether to block until the stack is deleted
+	deleteRetries int  // how many times to retry a failed deletion
+
+	// Resources that prevented the stack from being deleted
+	// by .DeleteStackAndWait(), if any.
+	BlockingResources []*BlockingResource
+
+	// When the stack will delete itself if StackTTLHours
+	// was set. Zero otherwise.
+	ExpiresAt     time.Time
+	stackTTLHours int  // how many hours after creation the stack expires
+	reuseStack    bool // whether to look for an existing stack before creating one
+
+	// The template version of a resumed stack and whether
+	// it's older than TemplateVersion. Populated by the
+	// first .Test() or by .CheckStackVersion().
+	StackTemplateVersion string
+	StackOutdated        bool
+	resumed              bool // whether the stack was given by StackName
+	versionChecked       bool // whether a resumed stack's version has been checked
+	upgradeStack         bool // whether to upgrade an outdated resumed stack
+
+	// Identifies the run that created the stack. Recorded
+	// in the stack's "fliptest:run-id" tag.
+	RunId string
+	tags  map[string]string // extra tags to add to the stack
+
+	// The outputs of the stack keyed by output name. Populated
+	// before the lambda is called so that custom templates can
+	// export extra values e.g. a log group name.
+	StackOutputs    map[string]string
+	stackParameters map[string]string // extra parameters for a custom template
+
+	// What .Test() would do. Populated by .Test() when
+	// DryRun was set.
+	TestPlan *TestPlan
+	dryRun   bool
+
+	// The IAM actions the caller was found to be missing
+	// by .Preflight(), if any.
+	MissingPermissions []string
+	preflight          bool // whether to check permissions before creating the stack
+	iamSvc             iamiface.IAMAPI
+	stsSvc             stsiface.STSAPI
+
+	executionRoleArn       string // existing role for the lambda, if any
+	permissionsBoundaryArn string // boundary for created roles, if any
+	rolePath               string // e.g. "/cs/"
+	roleNamePrefix         string // prefix for created role names, if any
+
+	securityGroupIds              []string // existing security groups for the lambda
+	excludeGeneratedSecurityGroup bool     // whether to skip creating a security group
+
+	memorySize          int    // lambda memory in MB, 0 for the template default
+	timeoutSeconds      int    // lambda timeout, 0 for the template default
+	architecture        string // e.g. "arm64"
+	reservedConcurrency int    // 0 for none
+	environment         string // JSON object of extra environment variables
+	kmsKeyArn           string // key for the lambda's environment, if any
+
+	batchSize          int // most test URLs per invocation
+	maxParallelInvokes int // most invocations at once
+
+	async               bool // whether to invoke the lambda asynchronously
+	asyncTimeoutMinutes int  // how long .Test() waits for asynchronous results
 
 	// The stack name will be available here in case the tests need
 	// to be resumed later.
@@ -210,11 +609,27 @@ type FlipTester struct {
 	context                   string // identifier used in logging e.g. account name
 	initialSleepTimeSeconds   int    // how long after stack is "ready" to sleep
 	postEventSleepTimeSeconds int    // how long after test event creation to sleep
+
+	probeConfig    *lambda.FunctionConfiguration // the lambda's configuration once it's looked up
+	probeInterface *ec2.NetworkInterface         // the lambda's ENI once it's looked up
+
+	logMu sync.Mutex // guards log, which batches write to concurrently
 }
 
 type lambdaEvent struct {
+	// Older lambdas ignore this and return a bare list
+	// of results.
+	ProtocolVersion int `json:",omitempty"`
+
 	RequestType string
 	TestUrls    []*TestUrl
+	Workers     int // how many tests the lambda runs at once
+
+	// Identify the run and batch. Asynchronous results
+	// come back with the event so they can be matched.
+	RunId   string `json:",omitempty"`
+	Batch   int    `json:",omitempty"`
+	Batches int    `json:",omitempty"`
 }
 
 // TestResult holds results from the lambda execution.
@@ -241,6 +656,8 @@ func (ft *FlipTester) logMessage(msg string) {
 	rMsg := fmt.Sprintf("%s: Context: '%s', StackName: '%s', Message: '%s'",
 		tString, ft.context, ft.StackName, msg,
 	)
+	ft.logMu.Lock()
+	defer ft.logMu.Unlock()
 	ft.log = append(ft.log, rMsg)
 }
 
@@ -253,8 +670,14 @@ func (ft *FlipTester) getTemplateBody() (body string, err error) {
 	return string(bodyBytes), err
 }
 
+// resultPassed applies the fixed pass criteria to a single
+// TestResult: the GET must have succeeded and taken no longer
+// than maxElapsedTimeS.
+func resultPassed(result *TestResult) bool {
+	return result.Success && result.ElapsedTimeS <= maxElapsedTimeS
+}
+
 func (ft *FlipTester) checkResults(results []*TestResult) error {
-	maxTime := 6.00000000
 	if len(results) < 1 {
 		msg := "tests failed; no test results to check"
 		ft.logMessage(msg)
@@ -265,7 +688,7 @@ func (ft *FlipTester) checkResults(results []*TestResult) error {
 			msg := fmt.Sprintf("test failed: %s", result.Url)
 			ft.logMessage(msg)
 			return errors.New(msg)
-		} else if result.ElapsedTimeS > maxTime {
+		} else if result.ElapsedTimeS > maxElapsedTimeS {
 			msg := fmt.Sprintf("test took too long: %s", result.Url)
 			ft.logMessage(msg)
 			return errors.New(msg)
@@ -282,29 +705,19 @@ func (ft *FlipTester) callLamda() (err error) {
 	if err != nil {
 		return err
 	}
-	msg = "preparing test event"
-	ft.logMessage(msg)
-	payload, err := json.Marshal(ft.testEvent)
-	if err != nil {
-		return err
-	}
-	inputInvoke := lambda.InvokeInput{
-		FunctionName:   &ft.functionName,
-		InvocationType: aws.String("RequestResponse"),
-		Payload:        payload,
-	}
-
 	msg = fmt.Sprintf("sleeping %ds before invoking lambda", ft.postEventSleepTimeSeconds)
 	ft.logMessage(msg)
 	time.Sleep(time.Second * time.Duration(ft.postEventSleepTimeSeconds))
 	msg = "invoking lambda"
 	ft.logMessage(msg)
 	svcL := lambda.New(ft.sess)
-	response, err := svcL.Invoke(&inputInvoke)
-	if err != nil {
-		return err
+	if ft.async {
+		err = ft.callLambdaAsync(svcL)
+	} else {
+		// partial results are kept when some batches fail
+		ft.TestResults, ft.Metadata, err = ft.invokeBatches(svcL)
 	}
-	err = json.Unmarshal(response.Payload, &ft.TestResults)
+	ft.resolveProbes(svcL, ft.Metadata)
 	if err != nil {
 		return err
 	}
@@ -342,13 +755,68 @@ func (ft *FlipTester) CreateStack() (err error) {
 		return err
 	}
 	// get random number to add into stack name
-	rand.Seed(time.Now().UnixNano())
-	stackName := ft.stackPrefix + fmt.Sprintf("%08d", rand.Intn(10000000))
+	randomMu.Lock()
+	stackName := ft.stackPrefix + fmt.Sprintf("%08d", random.Intn(10000000))
+	randomMu.Unlock()
+	var requestToken *string
+	if ft.reuseStack {
+		reused, nameTaken, err := ft.reuseExistingStack()
+		if err != nil || reused {
+			return err
+		}
+		if !nameTaken {
+			// a shared name and token make parallel creates
+			// of the same stack collapse into one
+			stackName = ft.sharedStackName()
+			requestToken = aws.String(ft.sharedStackName())
+		}
+	}
+	if ft.preflight {
+		_, err = ft.Preflight()
+		if err != nil {
+			return err
+		}
+	}
+	if ft.stackTTLHours > 0 {
+		ft.ExpiresAt = stackExpiry(ft.stackTTLHours)
+		msg = fmt.Sprintf("stack will delete itself at %s", ft.ExpiresAt.Format(time.RFC3339))
+		ft.logMessage(msg)
+	}
+	input := ft.createStackInput(stackName, templateBody, requestToken, ft.ExpiresAt)
+	msg = fmt.Sprintf("creating stack with name '%s'", stackName)
+	ft.logMessage(msg)
+	stackId := &stackName
+	response, err := ft.cfSvc.CreateStack(input)
+	if err != nil {
+		if !ft.reuseStack || !isAlreadyExists(err) {
+			return err
+		}
+		// another process beat us to it so wait for theirs
+		msg = "stack is already being created; waiting for it"
+		ft.logMessage(msg)
+	} else {
+		stackId = response.StackId
+	}
+	ft.StackName = *stackId
+	stack, err := ft.watchStack(stackId, 90)
+	if err != nil {
+		return err
+	}
+	ft.StackName = *stack.StackName
+	ft.stackCreated = true
+	return err
+}
+
+// createStackInput builds the request that creates the stack with
+// all of its parameters and tags. A zero expiresAt means the stack
+// doesn't expire.
+func (ft *FlipTester) createStackInput(stackName, templateBody string, requestToken *string, expiresAt time.Time) *cloudformation.CreateStackInput {
 	input := &cloudformation.CreateStackInput{
-		TimeoutInMinutes: aws.Int64(15),
-		StackName:        &stackName,
-		TemplateBody:     &templateBody,
-		OnFailure:        aws.String("DO_NOTHING"),
+		TimeoutInMinutes:   aws.Int64(15),
+		StackName:          &stackName,
+		TemplateBody:       &templateBody,
+		OnFailure:          aws.String("DO_NOTHING"),
+		ClientRequestToken: requestToken,
 		Capabilities: []*string{
 			aws.String("CAPABILITY_IAM"),
 			aws.String("CAPABILITY_NAMED_IAM"),
@@ -363,21 +831,119 @@ func (ft *FlipTester) CreateStack() (err error) {
 				ParameterValue: &ft.vpcId,
 			},
 		},
+		Tags: ft.stackTags(),
 	}
-	msg = fmt.Sprintf("creating stack with name '%s'", stackName)
-	ft.logMessage(msg)
-	response, err := ft.cfSvc.CreateStack(input)
-	if err != nil {
-		return err
+	for _, key := range sortedKeys(ft.stackParameters) {
+		input.Parameters = append(input.Parameters, &cloudformation.Parameter{
+			ParameterKey:   aws.String(key),
+			ParameterValue: aws.String(ft.stackParameters[key]),
+		})
 	}
-	ft.StackName = *response.StackId
-	stack, err := ft.watchStack(response.StackId, 90)
-	if err != nil {
-		return err
+	if ft.stackTemplateFilename == "" {
+		input.Parameters = append(input.Parameters, ft.roleParameters()...)
+		input.Parameters = append(input.Parameters, ft.securityGroupParameters()...)
+		input.Parameters = append(input.Parameters, ft.functionParameters()...)
+		if ft.async {
+			input.Parameters = append(input.Parameters, &cloudformation.Parameter{
+				ParameterKey:   aws.String("AsyncResults"),
+				ParameterValue: aws.String("true"),
+			})
+		}
 	}
-	ft.StackName = *stack.StackName
-	ft.stackCreated = true
-	return err
+	if !expiresAt.IsZero() {
+		input.Parameters = append(input.Parameters, &cloudformation.Parameter{
+			ParameterKey:   aws.String("CleanupSchedule"),
+			ParameterValue: aws.String(cleanupSchedule(expiresAt)),
+		})
+		input.Tags = append(input.Tags, &cloudformation.Tag{
+			Key:   aws.String(tagExpiresAt),
+			Value: aws.String(expiresAt.Format(time.RFC3339)),
+		})
+	}
+	return input
+}
+
+// stackExpiry returns when a stack created now with the given
+// TTL will delete itself. Schedules only have minute resolution
+// so it's rounded up to the next minute.
+func stackExpiry(ttlHours int) time.Time {
+	return time.Now().UTC().Add(time.Hour * time.Duration(ttlHours)).
+		Truncate(time.Minute).Add(time.Minute)
+}
+
+// stackTags returns the tags to add to a new stack: the
+// user's tags followed by fliptest's own.
+func (ft *FlipTester) stackTags() (tags []*cloudformation.Tag) {
+	for _, key := range sortedKeys(ft.tags) {
+		tags = append(tags, &cloudformation.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(ft.tags[key]),
+		})
+	}
+	tags = append(tags, []*cloudformation.Tag{
+		{
+			Key:   aws.String(tagTool),
+			Value: aws.String("fliptest"),
+		},
+		{
+			Key:   aws.String(tagRunId),
+			Value: aws.String(ft.RunId),
+		},
+		{
+			Key:   aws.String(tagTemplateVersion),
+			Value: aws.String(ft.templateVersion()),
+		},
+		{
+			Key:   aws.String(tagVpcId),
+			Value: aws.String(ft.vpcId),
+		},
+		{
+			Key:   aws.String(tagSubnetId),
+			Value: aws.String(ft.subnetId),
+		},
+		{
+			Key:   aws.String(tagConfigHash),
+			Value: aws.String(ft.configHash()),
+		},
+	}...)
+	if ft.async {
+		tags = append(tags, &cloudformation.Tag{
+			Key:   aws.String(tagAsyncResults),
+			Value: aws.String("true"),
+		})
+	}
+	return tags
+}
+
+// validateTags checks that the user's tags don't use a
+// reserved prefix and fit in the stack alongside fliptest's.
+func validateTags(tags map[string]string) error {
+	// stacks allow 50 tags and fliptest uses up to 8
+	if len(tags) > 42 {
+		return errors.New("no more than 42 Tags can be provided")
+	}
+	for key := range tags {
+		for _, prefix := range reservedTagPrefixes {
+			if strings.HasPrefix(strings.ToLower(key), prefix) {
+				return fmt.Errorf("tag key '%s' uses the reserved prefix '%s'", key, prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// newRunId returns a random identifier for a run.
+func newRunId() string {
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return fmt.Sprintf("%016x", random.Uint64())
+}
+
+// cleanupSchedule returns a schedule expression that
+// fires once at the given time.
+func cleanupSchedule(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("cron(%d %d %d %d ? %d)", t.Minute(), t.Hour(), t.Day(), t.Month(), t.Year())
 }
 
 func (ft *FlipTester) getStackInfo() (err error) {
@@ -389,17 +955,20 @@ func (ft *FlipTester) getStackInfo() (err error) {
 		return err
 	}
 	if len(response.Stacks) > 0 {
-		if len(response.Stacks[0].Outputs) > 0 {
-			if *response.Stacks[0].Outputs[0].OutputKey == "FunctionName" {
-				ft.functionName = *response.Stacks[0].Outputs[0].OutputValue
-			} else {
-				err = errors.New("error getting FunctionName output from existing stack")
-				return err
-			}
-		} else {
+		stack := response.Stacks[0]
+		if len(stack.Outputs) < 1 {
 			err = errors.New("no outputs detected on provided StackName")
 			return err
 		}
+		ft.StackOutputs = make(map[string]string)
+		for _, output := range stack.Outputs {
+			ft.StackOutputs[aws.StringValue(output.OutputKey)] = aws.StringValue(output.OutputValue)
+		}
+		ft.functionName = stackOutput(stack, "FunctionName")
+		if ft.functionName == "" {
+			err = errors.New("error getting FunctionName output from existing stack")
+			return err
+		}
 	} else {
 		err = errors.New("could not find stack with provided StackName")
 		return err
@@ -412,6 +981,12 @@ func (ft *FlipTester) getStackInfo() (err error) {
 func (ft *FlipTester) Test() (err error) {
 	msg := "starting test"
 	ft.logMessage(msg)
+	ft.Passed = false
+	ft.TestResults = nil
+	if ft.dryRun {
+		ft.TestPlan, err = ft.Plan()
+		return err
+	}
 	if !ft.stackCreated {
 		msg = "stack doesn't exist yet, creating stack"
 		ft.logMessage(msg)
@@ -419,6 +994,12 @@ func (ft *FlipTester) Test() (err error) {
 		if err != nil {
 			return err
 		}
+	} else if ft.resumed && !ft.versionChecked {
+		err = ft.upgradeIfOutdated()
+		if err != nil {
+			return err
+		}
+		ft.versionChecked = true
 	}
 	if ft.stackCreated {
 		msg = fmt.Sprintf("sleeping %d seconds before calling lambda", ft.initialSleepTimeSeconds)
@@ -430,7 +1011,9 @@ func (ft *FlipTester) Test() (err error) {
 		msg = "called lambda, processing errors"
 		ft.logMessage(msg)
 		for i := 0; i < 5; i++ {
-			if err != nil {
+			// an asynchronous run isn't retried since its batches
+			// may already be on their way to the queue
+			if err != nil && !ft.async {
 				if strings.Contains(err.Error(), "Service") {
 					// means we got that trash service exception
 					// even though Cloudformation told us the lambda
@@ -450,10 +1033,7 @@ func (ft *FlipTester) Test() (err error) {
 	if !ft.RetainStack {
 		msg = "deleting stack"
 		ft.logMessage(msg)
-		err = ft.DeleteStack()
-		if err == nil {
-			ft.stackCreated = false
-		}
+		err = ft.removeStack()
 	} else {
 		msg = "retaining stack"
 		ft.logMessage(msg)
@@ -471,6 +1051,8 @@ func (ft *FlipTester) Test() (err error) {
 // GetLog returns a string representing the log messages
 // from the life of the FlipTester object.
 func (ft *FlipTester) GetLog() string {
+	ft.logMu.Lock()
+	defer ft.logMu.Unlock()
 	return strings.Join(ft.log, "\n")
 }
 
@@ -492,6 +1074,10 @@ func (ft *FlipTester) watchStack(stackID *string, maxtries int) (*cloudformation
 		request.WithWaiterMaxAttempts(maxtries),
 	)
 	if err != nil {
+		if failure := ft.stackFailure(stackID); failure != "" {
+			err = fmt.Errorf("stack creation failed: %s", failure)
+			ft.logMessage(err.Error())
+		}
 		return nil, err
 	}
 	result, err := ft.cfSvc.DescribeStacks(&input)
@@ -501,3 +1087,64 @@ func (ft *FlipTester) watchStack(stackID *string, maxtries int) (*cloudformation
 	stack := result.Stacks[0]
 	return stack, nil
 }
+
+// stackFailure returns a description of the first resource that
+// failed in the stack's latest operation, taken from its events, or
+// an empty string if no failure was found. Resources that were only
+// cancelled because another one failed are skipped.
+func (ft *FlipTester) stackFailure(stackID *string) string {
+	var events []*cloudformation.StackEvent
+	err := ft.cfSvc.DescribeStackEventsPages(&cloudformation.DescribeStackEventsInput{
+		StackName: stackID,
+	}, func(page *cloudformation.DescribeStackEventsOutput, lastPage bool) bool {
+		for _, event := range page.StackEvents {
+			events = append(events, event)
+			if startsOperation(event) {
+				// older events belong to earlier operations
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		msg := fmt.Sprintf("could not describe stack events: %s", err.Error())
+		ft.logMessage(msg)
+		return ""
+	}
+	var stackReason string
+	// events come newest first
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		status := aws.StringValue(event.ResourceStatus)
+		reason := aws.StringValue(event.ResourceStatusReason)
+		if !strings.HasSuffix(status, "_FAILED") || strings.Contains(reason, "cancelled") {
+			continue
+		}
+		if aws.StringValue(event.ResourceType) == "AWS::CloudFormation::Stack" {
+			if stackReason == "" {
+				stackReason = reason
+			}
+			continue
+		}
+		return fmt.Sprintf("%s (%s) %s: %s", aws.StringValue(event.LogicalResourceId),
+			aws.StringValue(event.ResourceType), status, reason,
+		)
+	}
+	return stackReason
+}
+
+// startsOperation reports whether the event is the stack's own
+// event for the start of a create, update or delete.
+func startsOperation(event *cloudformation.StackEvent) bool {
+	if aws.StringValue(event.ResourceType) != "AWS::CloudFormation::Stack" {
+		return false
+	}
+	switch aws.StringValue(event.ResourceStatus) {
+	case cloudformation.ResourceStatusCreateInProgress,
+		cloudformation.ResourceStatusUpdateInProgress,
+		cloudformation.ResourceStatusDeleteInProgress,
+		cloudformation.ResourceStatusImportInProgress:
+		return true
+	}
+	return false
+}
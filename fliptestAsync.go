@@ -0,0 +1,235 @@
+package fliptest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// How long a result that belongs to another run is hidden from
+// this run's polling before it's received again.
+const otherRunVisibilityTimeout int64 = 5
+
+// asyncResult is the message a lambda destination sends to the
+// results queue after an asynchronous invocation.
+type asyncResult struct {
+	RequestContext struct {
+		Condition string `json:"condition"`
+	} `json:"requestContext"`
+	RequestPayload  *lambdaEvent    `json:"requestPayload"`
+	ResponsePayload json.RawMessage `json:"responsePayload"`
+}
+
+// StartAsync invokes the lambda asynchronously with the test suite,
+// split into batches like .Test() does, and returns without waiting
+// for the results. The stack must have a results queue i.e. it was
+// created with Async set. The results are tagged with .RunId and can
+// be collected with .CollectResults(), even by a FlipTester created
+// later with the same StackName and RunId.
+func (ft *FlipTester) StartAsync() (err error) {
+	err = ft.getStackInfo()
+	if err != nil {
+		return err
+	}
+	if ft.StackOutputs["ResultsQueueUrl"] == "" {
+		err = errors.New("stack has no ResultsQueueUrl output; create it with Async set")
+		return err
+	}
+	return ft.startAsync(lambda.New(ft.sess))
+}
+
+// CollectResults polls the stack's results queue until every batch
+// started by .StartAsync() for .RunId has reported or ctx is done,
+// then checks the results like .Test() does. The results that have
+// arrived are kept in .TestResults even if some are missing.
+func (ft *FlipTester) CollectResults(ctx context.Context) (err error) {
+	ft.Passed = false
+	err = ft.getStackInfo()
+	if err != nil {
+		return err
+	}
+	if ft.StackOutputs["ResultsQueueUrl"] == "" {
+		err = errors.New("stack has no ResultsQueueUrl output; create it with Async set")
+		return err
+	}
+	err = ft.collectAsync(ctx, sqs.New(ft.sess))
+	ft.resolveProbes(lambda.New(ft.sess), ft.Metadata)
+	if err != nil {
+		return err
+	}
+	err = ft.checkResults(ft.TestResults)
+	if err != nil {
+		return err
+	}
+	ft.Passed = true
+	return nil
+}
+
+// callLambdaAsync starts the suite asynchronously and waits
+// up to AsyncTimeoutMinutes for the results.
+func (ft *FlipTester) callLambdaAsync(svc lambdaiface.LambdaAPI) error {
+	if ft.StackOutputs["ResultsQueueUrl"] == "" {
+		return errors.New("stack has no ResultsQueueUrl output; create it with Async set")
+	}
+	err := ft.startAsync(svc)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Minute*time.Duration(ft.asyncTimeoutMinutes),
+	)
+	defer cancel()
+	return ft.collectAsync(ctx, sqs.New(ft.sess))
+}
+
+// startAsync invokes the lambda with InvocationType "Event" once
+// per batch. Each event records the run and its batch number so
+// that the results can be matched up when they're collected.
+func (ft *FlipTester) startAsync(svc lambdaiface.LambdaAPI) error {
+	groups := batches(ft.testEvent.TestUrls, ft.batchSize)
+	if len(groups) < 1 {
+		groups = [][]*TestUrl{nil}
+	}
+	for i, group := range groups {
+		payload, err := json.Marshal(&lambdaEvent{
+			ProtocolVersion: ProtocolVersion,
+			RequestType:     ft.testEvent.RequestType,
+			TestUrls:        group,
+			Workers:         ft.testEvent.Workers,
+			RunId:           ft.RunId,
+			Batch:           i,
+			Batches:         len(groups),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = svc.Invoke(&lambda.InvokeInput{
+			FunctionName:   &ft.functionName,
+			InvocationType: aws.String(lambda.InvocationTypeEvent),
+			Payload:        payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	msg := fmt.Sprintf("started %d asynchronous batches for run '%s'", len(groups), ft.RunId)
+	ft.logMessage(msg)
+	return nil
+}
+
+// collectAsync receives this run's results from the queue until
+// all of its batches are in or ctx is done and merges them into
+// .TestResults in batch order. The run's messages are only deleted
+// once every batch is in so that a later call can start over if
+// this one gives up. Results for other runs are left on the queue.
+func (ft *FlipTester) collectAsync(ctx context.Context, svc sqsiface.SQSAPI) (err error) {
+	queueUrl := ft.StackOutputs["ResultsQueueUrl"]
+	received := make(map[int]*lambdaResponse)
+	failed := make(map[int]string)
+	handles := make(map[string]*string) // latest receipt handle by message ID
+	total := 0                          // unknown until the first result arrives
+	msg := fmt.Sprintf("collecting results for run '%s'", ft.RunId)
+	ft.logMessage(msg)
+	for total == 0 || len(received)+len(failed) < total {
+		if ctx.Err() != nil {
+			break
+		}
+		response, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            &queueUrl,
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		for _, message := range response.Messages {
+			var result asyncResult
+			err := json.Unmarshal([]byte(aws.StringValue(message.Body)), &result)
+			if err != nil || result.RequestPayload == nil || result.RequestPayload.RunId != ft.RunId {
+				// someone else's so let them have it back soon
+				svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          &queueUrl,
+					ReceiptHandle:     message.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(otherRunVisibilityTimeout),
+				})
+				continue
+			}
+			handles[aws.StringValue(message.MessageId)] = message.ReceiptHandle
+			batch := result.RequestPayload.Batch
+			total = result.RequestPayload.Batches
+			if _, ok := received[batch]; ok {
+				// seen again after its visibility timeout
+				continue
+			}
+			if _, ok := failed[batch]; ok {
+				continue
+			}
+			if result.RequestContext.Condition == "Success" {
+				var response *lambdaResponse
+				response, err = parseResponse(result.ResponsePayload)
+				if err == nil {
+					received[batch] = response
+				}
+			} else {
+				err = fmt.Errorf("%s %s", result.RequestContext.Condition, string(result.ResponsePayload))
+			}
+			if err != nil {
+				failed[batch] = err.Error()
+				msg = fmt.Sprintf("batch %d failed: %s", batch+1, err.Error())
+				ft.logMessage(msg)
+			}
+		}
+	}
+	ft.TestResults = nil
+	ft.Metadata = nil
+	for batch := 0; batch < total; batch++ {
+		if response, ok := received[batch]; ok {
+			ft.TestResults = append(ft.TestResults, response.Results...)
+			ft.Metadata = append(ft.Metadata, response.Metadata)
+		} else {
+			ft.Metadata = append(ft.Metadata, nil)
+		}
+	}
+	ft.noteOldProtocol(ft.Metadata)
+	if total == 0 || len(received)+len(failed) < total {
+		// the messages stay on the queue for the next attempt
+		err = fmt.Errorf("stopped waiting for results with %d of %d batches collected: %v",
+			len(received)+len(failed), total, ctx.Err(),
+		)
+		return err
+	}
+	for _, handle := range handles {
+		_, err = svc.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      &queueUrl,
+			ReceiptHandle: handle,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		var reasons []string
+		for batch := 0; batch < total; batch++ {
+			if reason, ok := failed[batch]; ok {
+				reasons = append(reasons, fmt.Sprintf("batch %d: %s", batch+1, reason))
+			}
+		}
+		err = errors.New("some batches failed: " + strings.Join(reasons, "; "))
+		return err
+	}
+	msg = fmt.Sprintf("collected all %d batches", total)
+	ft.logMessage(msg)
+	return nil
+}
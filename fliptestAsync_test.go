@@ -0,0 +1,146 @@
+package fliptest
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// fakeSQS hands out its messages one per receive and records
+// which ones were deleted or handed back. Received messages are
+// hidden until .expire() makes the undeleted ones visible again.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	messages []string
+	inFlight []string
+	deleted  []string
+	returned []string
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput,
+	opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if len(f.messages) < 1 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	body := f.messages[0]
+	f.messages = f.messages[1:]
+	f.inFlight = append(f.inFlight, body)
+	return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{
+		{Body: aws.String(body), ReceiptHandle: aws.String(body), MessageId: aws.String(body)},
+	}}, nil
+}
+
+func (f *fakeSQS) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	f.deleted = append(f.deleted, *input.ReceiptHandle)
+	for i, body := range f.inFlight {
+		if body == *input.ReceiptHandle {
+			f.inFlight = append(f.inFlight[:i], f.inFlight[i+1:]...)
+			break
+		}
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// expire ends the visibility timeout of every received
+// message that wasn't deleted.
+func (f *fakeSQS) expire() {
+	f.messages = append(f.messages, f.inFlight...)
+	f.inFlight = nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.returned = append(f.returned, *input.ReceiptHandle)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func destinationMessage(t *testing.T, runId string, batch, batches int, names ...string) string {
+	var results []*TestResult
+	for _, name := range names {
+		results = append(results, &TestResult{Name: name, Success: true})
+	}
+	response, _ := json.Marshal(results)
+	var result asyncResult
+	result.RequestContext.Condition = "Success"
+	result.RequestPayload = &lambdaEvent{RunId: runId, Batch: batch, Batches: batches}
+	result.ResponsePayload = response
+	body, err := json.Marshal(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCollectAsync(t *testing.T) {
+	other := destinationMessage(t, "other-run", 0, 1, "x")
+	svc := &fakeSQS{messages: []string{
+		destinationMessage(t, "run-1", 1, 2, "c"),
+		other,
+		destinationMessage(t, "run-1", 0, 2, "a", "b"),
+	}}
+	ft := &FlipTester{RunId: "run-1", StackOutputs: map[string]string{"ResultsQueueUrl": "queue"}}
+	err := ft.collectAsync(context.Background(), svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, result := range ft.TestResults {
+		names = append(names, result.Name)
+	}
+	if got := strings.Join(names, ","); got != "a,b,c" {
+		t.Errorf("got results %s, want a,b,c", got)
+	}
+	if len(svc.deleted) != 2 || len(svc.returned) != 1 || svc.returned[0] != other {
+		t.Errorf("deleted %d and returned %d messages, want 2 and the other run's", len(svc.deleted), len(svc.returned))
+	}
+}
+
+func TestCollectAsyncTimeout(t *testing.T) {
+	svc := &fakeSQS{messages: []string{destinationMessage(t, "run-1", 1, 3, "c")}}
+	ft := &FlipTester{RunId: "run-1", StackOutputs: map[string]string{"ResultsQueueUrl": "queue"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ft.collectAsync(ctx, svc)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 batches") {
+		t.Errorf("got error %v, want 1 of 3 batches collected", err)
+	}
+	if len(ft.TestResults) != 1 || ft.TestResults[0].Name != "c" {
+		t.Errorf("got %d results, want the partial result", len(ft.TestResults))
+	}
+}
+
+func TestCollectAsyncResumes(t *testing.T) {
+	svc := &fakeSQS{messages: []string{destinationMessage(t, "run-1", 1, 2, "c")}}
+	ft := &FlipTester{RunId: "run-1", StackOutputs: map[string]string{"ResultsQueueUrl": "queue"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ft.collectAsync(ctx, svc)
+	if err == nil || len(svc.deleted) > 0 {
+		t.Fatalf("got error %v and %d deletions, want a timeout that leaves the queue alone", err, len(svc.deleted))
+	}
+	// the last batch arrives and another process resumes
+	svc.expire()
+	svc.messages = append(svc.messages, destinationMessage(t, "run-1", 0, 2, "a", "b"))
+	resumed := &FlipTester{RunId: "run-1", StackOutputs: map[string]string{"ResultsQueueUrl": "queue"}}
+	err = resumed.collectAsync(context.Background(), svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, result := range resumed.TestResults {
+		names = append(names, result.Name)
+	}
+	if got := strings.Join(names, ","); got != "a,b,c" {
+		t.Errorf("got results %s, want a,b,c", got)
+	}
+	if len(svc.deleted) != 2 || len(svc.inFlight) > 0 {
+		t.Errorf("deleted %d messages, want both once every batch was in", len(svc.deleted))
+	}
+}
@@ -0,0 +1,118 @@
+package fliptest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// batches splits the test URLs into groups of at most size.
+func batches(urls []*TestUrl, size int) (groups [][]*TestUrl) {
+	for start := 0; start < len(urls); start += size {
+		end := start + size
+		if end > len(urls) {
+			end = len(urls)
+		}
+		groups = append(groups, urls[start:end])
+	}
+	return groups
+}
+
+// invokeBatches runs the suite in batches of batchSize with at most
+// maxParallelInvokes invocations at once and returns the results in
+// the same order as the test URLs, along with each batch's metadata
+// (nil for failed batches). Results from the batches that succeeded
+// are returned even if others failed.
+func (ft *FlipTester) invokeBatches(svc lambdaiface.LambdaAPI) (results []*TestResult, metadata []*RunMetadata, err error) {
+	groups := batches(ft.testEvent.TestUrls, ft.batchSize)
+	if len(groups) < 1 {
+		// no tests so let the lambda run its defaults
+		groups = [][]*TestUrl{nil}
+	}
+	batchResponses := make([]*lambdaResponse, len(groups))
+	batchErrors := make([]error, len(groups))
+	var wg sync.WaitGroup
+	parallel := ft.maxParallelInvokes
+	if ft.reservedConcurrency > 0 && ft.reservedConcurrency < parallel {
+		// any more would be throttled
+		parallel = ft.reservedConcurrency
+	}
+	sem := make(chan struct{}, parallel)
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group []*TestUrl) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			msg := fmt.Sprintf("invoking lambda with batch %d of %d", i+1, len(groups))
+			ft.logMessage(msg)
+			batchResponses[i], batchErrors[i] = ft.invokeBatch(svc, &lambdaEvent{
+				ProtocolVersion: ProtocolVersion,
+				RequestType:     ft.testEvent.RequestType,
+				TestUrls:        group,
+				Workers:         ft.testEvent.Workers,
+				RunId:           ft.RunId,
+				Batch:           i,
+				Batches:         len(groups),
+			})
+			if batchErrors[i] != nil {
+				msg = fmt.Sprintf("batch %d failed: %s", i+1, batchErrors[i].Error())
+				ft.logMessage(msg)
+			}
+		}(i, group)
+	}
+	wg.Wait()
+	var failed []string
+	for i := range groups {
+		if batchResponses[i] != nil {
+			results = append(results, batchResponses[i].Results...)
+			metadata = append(metadata, batchResponses[i].Metadata)
+		} else {
+			metadata = append(metadata, nil)
+		}
+		if batchErrors[i] != nil {
+			failed = append(failed, fmt.Sprintf("batch %d: %s", i+1, batchErrors[i].Error()))
+		}
+	}
+	ft.noteOldProtocol(metadata)
+	if len(failed) > 0 {
+		err = errors.New("some batches failed: " + strings.Join(failed, "; "))
+	}
+	return results, metadata, err
+}
+
+// invokeBatch invokes the lambda synchronously with one
+// event e.g. a batch of test URLs and returns its response.
+func (ft *FlipTester) invokeBatch(svc lambdaiface.LambdaAPI, event *lambdaEvent) (*lambdaResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	response, err := svc.Invoke(&lambda.InvokeInput{
+		FunctionName:   &ft.functionName,
+		InvocationType: aws.String("RequestResponse"),
+		Payload:        payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.FunctionError != nil {
+		// the payload describes the error e.g. a timeout
+		var functionErr struct {
+			ErrorType    string `json:"errorType"`
+			ErrorMessage string `json:"errorMessage"`
+		}
+		json.Unmarshal(response.Payload, &functionErr)
+		err = fmt.Errorf("lambda returned %s error: %s %s", aws.StringValue(response.FunctionError),
+			functionErr.ErrorType, functionErr.ErrorMessage,
+		)
+		return nil, err
+	}
+	return parseResponse(response.Payload)
+}
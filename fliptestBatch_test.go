@@ -0,0 +1,224 @@
+package fliptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// fakeLambda answers each invocation with a passing result per
+// test URL. Batches containing a URL in fail return a function
+// error instead. Earlier batches are slower so that they finish
+// out of order. With legacy set it answers with the bare list
+// that lambdas from before the response envelope return.
+type fakeLambda struct {
+	lambdaiface.LambdaAPI
+	fail   map[string]bool
+	legacy bool
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int // the most invocations running at once
+}
+
+func (f *fakeLambda) Invoke(input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+	var event lambdaEvent
+	err := json.Unmarshal(input.Payload, &event)
+	if err != nil {
+		return nil, err
+	}
+	var results []*TestResult
+	for _, test := range event.TestUrls {
+		if f.fail[test.Url] {
+			return &lambda.InvokeOutput{
+				FunctionError: aws.String("Unhandled"),
+				Payload:       []byte(`{"errorType":"Sandbox.Timedout","errorMessage":"Task timed out"}`),
+			}, nil
+		}
+		results = append(results, &TestResult{Name: test.Name, Url: test.Url, Success: true})
+	}
+	if len(event.TestUrls) > 0 && strings.HasSuffix(event.TestUrls[0].Name, "-0") {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if f.legacy {
+		payload, err := json.Marshal(results)
+		return &lambda.InvokeOutput{Payload: payload}, err
+	}
+	payload, err := json.Marshal(&lambdaResponse{
+		ProtocolVersion: event.ProtocolVersion,
+		RunId:           event.RunId,
+		Batch:           event.Batch,
+		Results:         results,
+		Metadata: &RunMetadata{
+			RequestId: fmt.Sprintf("request-%d", event.Batch),
+			Probe:     &ProbeInfo{LocalIp: "169.254.0.1"},
+		},
+	})
+	return &lambda.InvokeOutput{Payload: payload}, err
+}
+
+// GetFunctionConfiguration describes a function with a 60
+// second timeout and 256 MB that isn't attached to a VPC.
+func (f *fakeLambda) GetFunctionConfiguration(input *lambda.GetFunctionConfigurationInput) (*lambda.FunctionConfiguration, error) {
+	return &lambda.FunctionConfiguration{
+		FunctionName: input.FunctionName,
+		Timeout:      aws.Int64(60),
+		MemorySize:   aws.Int64(256),
+	}, nil
+}
+
+func newBatchTester(count, batchSize int) *FlipTester {
+	ft := &FlipTester{
+		batchSize:          batchSize,
+		maxParallelInvokes: 3,
+		testEvent:          &lambdaEvent{RequestType: "RunAll"},
+	}
+	for i := 0; i < count; i++ {
+		ft.testEvent.TestUrls = append(ft.testEvent.TestUrls, &TestUrl{
+			Name: fmt.Sprintf("test-%d", i),
+			Url:  fmt.Sprintf("https://%d.example.com", i),
+		})
+	}
+	return ft
+}
+
+func TestInvokeBatchesKeepsOrder(t *testing.T) {
+	ft := newBatchTester(23, 5)
+	results, metadata, err := ft.invokeBatches(&fakeLambda{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 23 {
+		t.Fatalf("got %d results, want 23", len(results))
+	}
+	for i, result := range results {
+		if want := fmt.Sprintf("test-%d", i); result.Name != want {
+			t.Errorf("result %d is %s, want %s", i, result.Name, want)
+		}
+	}
+	if len(metadata) != 5 {
+		t.Fatalf("got %d metadata, want 5", len(metadata))
+	}
+	for i, m := range metadata {
+		if want := fmt.Sprintf("request-%d", i); m.RequestId != want || m.ProtocolVersion != ProtocolVersion ||
+			m.Probe == nil || m.Probe.LocalIp != "169.254.0.1" {
+			t.Errorf("metadata %d is %+v, want %s", i, m, want)
+		}
+	}
+}
+
+func TestInvokeBatchesOldProtocol(t *testing.T) {
+	ft := newBatchTester(3, 5)
+	results, metadata, err := ft.invokeBatches(&fakeLambda{legacy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || len(metadata) != 1 || metadata[0].ProtocolVersion != 1 {
+		t.Errorf("got %d results and %+v, want 3 results from protocol version 1", len(results), metadata)
+	}
+	if !strings.Contains(ft.GetLog(), "upgrade the stack") {
+		t.Error("want a suggestion to upgrade the stack in the log")
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	_, err := parseResponse([]byte(`{"ProtocolVersion":99,"Results":[]}`))
+	if err == nil || !strings.Contains(err.Error(), "upgrade fliptest") {
+		t.Errorf("got error %v, want newer protocol to be rejected", err)
+	}
+	// a newer lambda answering an older client's request in
+	// the client's version, with fields the client doesn't know
+	response, err := parseResponse([]byte(`{"ProtocolVersion":2,"Results":[{"Name":"a"}],` +
+		`"Metadata":{"RequestId":"r","Probe":{"LocalIp":"169.254.0.1"},"Added":true}}`))
+	if err != nil || len(response.Results) != 1 || response.Metadata.ProtocolVersion != 2 {
+		t.Errorf("got %+v and error %v, want an older version's response to be accepted", response, err)
+	}
+	_, err = parseResponse([]byte(`{"errorMessage":"oops"}`))
+	if err == nil || !strings.Contains(err.Error(), "unrecognized") {
+		t.Errorf("got error %v, want unversioned object to be rejected", err)
+	}
+}
+
+func TestInvokeBatchesKeepsPartialResults(t *testing.T) {
+	ft := newBatchTester(10, 5)
+	results, metadata, err := ft.invokeBatches(&fakeLambda{
+		fail: map[string]bool{"https://7.example.com": true},
+	})
+	if err == nil || !strings.Contains(err.Error(), "batch 2") || !strings.Contains(err.Error(), "Task timed out") {
+		t.Errorf("got error %v, want batch 2 to time out", err)
+	}
+	if len(results) != 5 || results[0].Name != "test-0" {
+		t.Errorf("got %d results, want the 5 from batch 1", len(results))
+	}
+	if len(metadata) != 2 || metadata[0] == nil || metadata[1] != nil {
+		t.Errorf("got metadata %v, want batch 1's and nil for batch 2", metadata)
+	}
+}
+
+func TestInvokeBatchesRespectsReservedConcurrency(t *testing.T) {
+	ft := newBatchTester(20, 2)
+	ft.reservedConcurrency = 2
+	svc := &fakeLambda{}
+	_, _, err := ft.invokeBatches(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.maxInFlight > 2 {
+		t.Errorf("got %d invocations at once, want no more than the reserved 2", svc.maxInFlight)
+	}
+}
+
+func TestMatchingInterface(t *testing.T) {
+	eni := func(id string, groups ...string) *ec2.NetworkInterface {
+		n := &ec2.NetworkInterface{NetworkInterfaceId: aws.String(id)}
+		for _, group := range groups {
+			n.Groups = append(n.Groups, &ec2.GroupIdentifier{GroupId: aws.String(group)})
+		}
+		return n
+	}
+	enis := []*ec2.NetworkInterface{eni("eni-a", "sg-1"), eni("eni-b", "sg-2", "sg-1"), eni("eni-c", "sg-1", "sg-2", "sg-3")}
+	got := matchingInterface(enis, []string{"sg-1", "sg-2"})
+	if got == nil || *got.NetworkInterfaceId != "eni-b" {
+		t.Errorf("got %v, want eni-b", got)
+	}
+	if got := matchingInterface(enis, []string{"sg-4"}); got != nil {
+		t.Errorf("got %v, want no match", got)
+	}
+}
+
+func TestResolveProbesReadsConfiguration(t *testing.T) {
+	ft := newBatchTester(2, 5)
+	_, metadata, err := ft.invokeBatches(&fakeLambda{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.resolveProbes(&fakeLambda{}, metadata)
+	probe := metadata[0].Probe
+	if probe.TimeoutSeconds != 60 || probe.MemorySize != 256 {
+		t.Errorf("got timeout %ds and memory %dMB, want the function's 60s and 256MB",
+			probe.TimeoutSeconds, probe.MemorySize,
+		)
+	}
+	if !strings.Contains(ft.GetLog(), "network interface") {
+		t.Error("want the missing network interface logged")
+	}
+}
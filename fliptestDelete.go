@@ -0,0 +1,187 @@
+package fliptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// How long to wait before the first retry of a failed
+// deletion. Doubled for every retry after that.
+const deleteRetryBackoff = 2 * time.Minute
+
+// BlockingResource describes a stack resource that could not be
+// deleted along with anything found to be holding on to it.
+type BlockingResource struct {
+	LogicalResourceId  string
+	PhysicalResourceId string
+	ResourceType       string
+	StatusReason       string
+
+	// For security groups, the network interfaces that
+	// are still using the group. These are usually
+	// Lambda managed ENIs that haven't been released yet.
+	NetworkInterfaces []*BlockingNetworkInterface
+}
+
+// BlockingNetworkInterface is a network interface that is
+// keeping a stack's security group alive.
+type BlockingNetworkInterface struct {
+	NetworkInterfaceId string
+	Description        string
+	Status             string
+	InterfaceType      string
+	RequesterId        string
+}
+
+func (br *BlockingResource) String() string {
+	msg := fmt.Sprintf("%s (%s %s): %s",
+		br.LogicalResourceId, br.ResourceType, br.PhysicalResourceId, br.StatusReason,
+	)
+	for _, eni := range br.NetworkInterfaces {
+		msg += fmt.Sprintf("; in use by %s '%s' (%s)",
+			eni.NetworkInterfaceId, eni.Description, eni.Status,
+		)
+	}
+	return msg
+}
+
+// DeleteStackAndWait deletes the Cloudformation stack and blocks
+// until it reaches DELETE_COMPLETE. If the deletion fails then the
+// resources blocking it are recorded in .BlockingResources and the
+// deletion is retried with backoff up to DeleteRetries times. When
+// it returns without error the stack and its ENIs are gone from
+// the subnet.
+func (ft *FlipTester) DeleteStackAndWait() (err error) {
+	ft.BlockingResources, err = deleteStackAndWait(ft.cfSvc, ft.ec2Svc,
+		ft.StackName, ft.deleteRetries, ft.logMessage,
+	)
+	return err
+}
+
+// removeStack deletes the stack the way the FlipTester was
+// configured to, waiting for the deletion if WaitForDelete was set.
+func (ft *FlipTester) removeStack() (err error) {
+	if ft.waitForDelete {
+		err = ft.DeleteStackAndWait()
+	} else {
+		err = ft.DeleteStack()
+	}
+	if err == nil {
+		ft.stackCreated = false
+	}
+	return err
+}
+
+func deleteStackAndWait(cfSvc cloudformationiface.CloudFormationAPI, ec2Svc ec2iface.EC2API,
+	stackName string, retries int, logMessage func(string)) (blocking []*BlockingResource, err error) {
+	backoff := deleteRetryBackoff
+	for attempt := 0; ; attempt++ {
+		_, err = cfSvc.DeleteStack(&cloudformation.DeleteStackInput{
+			StackName: aws.String(stackName),
+		})
+		if err != nil {
+			return blocking, err
+		}
+		msg := "deleting stack; awaiting completion"
+		logMessage(msg)
+		err = cfSvc.WaitUntilStackDeleteCompleteWithContext(context.Background(),
+			&cloudformation.DescribeStacksInput{StackName: aws.String(stackName)},
+			request.WithWaiterDelay(request.ConstantWaiterDelay(15*time.Second)),
+			request.WithWaiterMaxAttempts(120),
+		)
+		if err == nil {
+			msg = "stack deleted"
+			logMessage(msg)
+			return nil, nil
+		}
+		var findErr error
+		blocking, findErr = blockingResources(cfSvc, ec2Svc, stackName)
+		if findErr != nil {
+			msg = fmt.Sprintf("could not find blocking resources: %s", findErr.Error())
+			logMessage(msg)
+		}
+		var reasons []string
+		for _, br := range blocking {
+			reasons = append(reasons, br.String())
+		}
+		if len(reasons) > 0 {
+			msg = fmt.Sprintf("stack deletion blocked by %s", strings.Join(reasons, "; "))
+			logMessage(msg)
+			err = errors.New(msg)
+		}
+		if attempt >= retries {
+			return blocking, err
+		}
+		msg = fmt.Sprintf("retrying deletion in %s", backoff)
+		logMessage(msg)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// blockingResources returns the stack's resources that failed to
+// delete. For security groups it also looks up the network
+// interfaces still attached to the group.
+func blockingResources(cfSvc cloudformationiface.CloudFormationAPI, ec2Svc ec2iface.EC2API,
+	stackName string) (blocking []*BlockingResource, err error) {
+	response, err := cfSvc.DescribeStackResources(&cloudformation.DescribeStackResourcesInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, resource := range response.StackResources {
+		if aws.StringValue(resource.ResourceStatus) != cloudformation.ResourceStatusDeleteFailed {
+			continue
+		}
+		br := &BlockingResource{
+			LogicalResourceId:  aws.StringValue(resource.LogicalResourceId),
+			PhysicalResourceId: aws.StringValue(resource.PhysicalResourceId),
+			ResourceType:       aws.StringValue(resource.ResourceType),
+			StatusReason:       aws.StringValue(resource.ResourceStatusReason),
+		}
+		if br.ResourceType == "AWS::EC2::SecurityGroup" && br.PhysicalResourceId != "" {
+			br.NetworkInterfaces, err = securityGroupInterfaces(ec2Svc, br.PhysicalResourceId)
+			if err != nil {
+				return blocking, err
+			}
+		}
+		blocking = append(blocking, br)
+	}
+	return blocking, nil
+}
+
+func securityGroupInterfaces(svc ec2iface.EC2API, groupId string) (enis []*BlockingNetworkInterface, err error) {
+	input := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("group-id"),
+				Values: []*string{aws.String(groupId)},
+			},
+		},
+	}
+	err = svc.DescribeNetworkInterfacesPages(input,
+		func(page *ec2.DescribeNetworkInterfacesOutput, lastPage bool) bool {
+			for _, eni := range page.NetworkInterfaces {
+				enis = append(enis, &BlockingNetworkInterface{
+					NetworkInterfaceId: aws.StringValue(eni.NetworkInterfaceId),
+					Description:        aws.StringValue(eni.Description),
+					Status:             aws.StringValue(eni.Status),
+					InterfaceType:      aws.StringValue(eni.InterfaceType),
+					RequesterId:        aws.StringValue(eni.RequesterId),
+				})
+			}
+			return true
+		})
+	return enis, err
+}
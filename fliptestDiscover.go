@@ -0,0 +1,241 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+)
+
+// The role that AWS Organizations creates in member accounts.
+// Used by Discover unless another RoleName is provided.
+const DefaultDiscoverRoleName string = "OrganizationAccountAccessRole"
+
+// DiscoverInput provides all of the information necessary
+// to discover Targets with Discover.
+type DiscoverInput struct {
+
+	// A session in the organization's management account
+	// (or a delegated administrator) from which the
+	// accounts are listed and each RoleName is assumed.
+	// If no session is provided then one will be created
+	// using system defaults.
+	Session *session.Session
+
+	// Only discover accounts in this organizational unit
+	// and the OUs beneath it. If empty every account in
+	// the organization is discovered.
+	OrganizationalUnitId string
+
+	// The name of the role to assume in each account.
+	// Default: DefaultDiscoverRoleName
+	RoleName string
+
+	// The external ID to provide when assuming RoleName,
+	// if the role requires one.
+	ExternalId string
+
+	// The regions in which to look for VPCs.
+	// Default: the session's region
+	Regions []string
+
+	// Tags a VPC must have to be discovered. An empty
+	// value matches any value for that key.
+	VpcTags map[string]string
+
+	// Tags a subnet must have to be included in a
+	// discovered Target. An empty value matches any
+	// value for that key.
+	SubnetTags map[string]string
+
+	// The maximum number of accounts to search at the
+	// same time.
+	// Default: 10
+	MaxConcurrency int
+}
+
+// Discover lists the active accounts in an AWS Organization (or one of
+// its OUs), assumes RoleName in each and returns a Target for every VPC
+// in the chosen regions that matches the tag filters. The Targets can be
+// passed straight to NewRunner. Accounts that could not be searched are
+// reported in the returned error alongside the Targets that were found.
+func Discover(input *DiscoverInput) (targets []*Target, err error) {
+	if input.Session == nil {
+		input.Session, err = session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	d := &discoverer{
+		input:  input,
+		orgSvc: organizations.New(input.Session),
+		ec2For: func(target *Target) ec2iface.EC2API {
+			return ec2.New(targetSession(input.Session, target))
+		},
+	}
+	return d.discover()
+}
+
+// discoverer holds the clients used by Discover so that
+// they can be replaced with local stand-ins.
+type discoverer struct {
+	input  *DiscoverInput
+	orgSvc organizationsiface.OrganizationsAPI
+	ec2For func(target *Target) ec2iface.EC2API
+}
+
+func (d *discoverer) discover() (targets []*Target, err error) {
+	input := d.input
+	if input.RoleName == "" {
+		input.RoleName = DefaultDiscoverRoleName
+	}
+	if len(input.Regions) < 1 {
+		input.Regions = []string{aws.StringValue(input.Session.Config.Region)}
+	}
+	if input.MaxConcurrency == 0 {
+		input.MaxConcurrency = 10
+	}
+	accountIds, err := d.listAccounts()
+	if err != nil {
+		return nil, err
+	}
+	partition := partitionForRegion(input.Regions[0])
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	sem := make(chan struct{}, input.MaxConcurrency)
+	for _, accountId := range accountIds {
+		wg.Add(1)
+		go func(accountId string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			roleArn := fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, accountId, input.RoleName)
+			found, err := d.discoverAccount(accountId, roleArn)
+			mu.Lock()
+			defer mu.Unlock()
+			targets = append(targets, found...)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", accountId, err.Error()))
+			}
+		}(accountId)
+	}
+	wg.Wait()
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Context < targets[j].Context
+	})
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		err = errors.New("could not discover some accounts: " + strings.Join(failed, "; "))
+	}
+	return targets, err
+}
+
+// discoverAccount returns a Target for every matching
+// VPC in the account across all of the regions.
+func (d *discoverer) discoverAccount(accountId, roleArn string) (targets []*Target, err error) {
+	for _, region := range d.input.Regions {
+		svc := d.ec2For(&Target{
+			RoleArn:    roleArn,
+			ExternalId: d.input.ExternalId,
+			Region:     region,
+		})
+		var vpcIds []string
+		err = svc.DescribeVpcsPages(&ec2.DescribeVpcsInput{Filters: tagFilters(d.input.VpcTags)},
+			func(page *ec2.DescribeVpcsOutput, lastPage bool) bool {
+				for _, vpc := range page.Vpcs {
+					vpcIds = append(vpcIds, *vpc.VpcId)
+				}
+				return true
+			})
+		if err != nil {
+			return targets, err
+		}
+		for _, vpcId := range vpcIds {
+			subnetIds, err := findSubnets(svc, vpcId, d.input.SubnetTags)
+			if err != nil {
+				return targets, err
+			}
+			if len(subnetIds) < 1 {
+				continue
+			}
+			targets = append(targets, &Target{
+				Context:    fmt.Sprintf("%s/%s/%s", accountId, region, vpcId),
+				RoleArn:    roleArn,
+				ExternalId: d.input.ExternalId,
+				Region:     region,
+				VpcId:      vpcId,
+				SubnetIds:  subnetIds,
+				SubnetTags: d.input.SubnetTags,
+			})
+		}
+	}
+	return targets, nil
+}
+
+// listAccounts returns the IDs of the active accounts in the
+// organization or, if one was provided, the OU and its children.
+func (d *discoverer) listAccounts() (accountIds []string, err error) {
+	addAccounts := func(accounts []*organizations.Account) {
+		for _, account := range accounts {
+			if aws.StringValue(account.Status) == organizations.AccountStatusActive {
+				accountIds = append(accountIds, *account.Id)
+			}
+		}
+	}
+	if d.input.OrganizationalUnitId == "" {
+		err = d.orgSvc.ListAccountsPages(&organizations.ListAccountsInput{},
+			func(page *organizations.ListAccountsOutput, lastPage bool) bool {
+				addAccounts(page.Accounts)
+				return true
+			})
+		return accountIds, err
+	}
+	parents := []string{d.input.OrganizationalUnitId}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+		err = d.orgSvc.ListAccountsForParentPages(
+			&organizations.ListAccountsForParentInput{ParentId: aws.String(parent)},
+			func(page *organizations.ListAccountsForParentOutput, lastPage bool) bool {
+				addAccounts(page.Accounts)
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+		err = d.orgSvc.ListChildrenPages(
+			&organizations.ListChildrenInput{
+				ParentId:  aws.String(parent),
+				ChildType: aws.String(organizations.ChildTypeOrganizationalUnit),
+			},
+			func(page *organizations.ListChildrenOutput, lastPage bool) bool {
+				for _, child := range page.Children {
+					parents = append(parents, *child.Id)
+				}
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return accountIds, nil
+}
+
+// partitionForRegion returns the partition (e.g. "aws",
+// "aws-us-gov" or "aws-cn") that the region belongs to.
+func partitionForRegion(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.ID()
+	}
+	return endpoints.AwsPartitionID
+}
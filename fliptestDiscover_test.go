@@ -0,0 +1,213 @@
+package fliptest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+)
+
+// fakeOrg stands in for the Organizations API with a
+// root OU "ou-root" containing a child OU "ou-child".
+type fakeOrg struct {
+	organizationsiface.OrganizationsAPI
+	accounts map[string][]*organizations.Account // keyed by parent
+	children map[string][]string                 // keyed by parent
+}
+
+func (f *fakeOrg) ListAccountsPages(input *organizations.ListAccountsInput,
+	fn func(*organizations.ListAccountsOutput, bool) bool) error {
+	var all []*organizations.Account
+	for _, accounts := range f.accounts {
+		all = append(all, accounts...)
+	}
+	fn(&organizations.ListAccountsOutput{Accounts: all}, true)
+	return nil
+}
+
+func (f *fakeOrg) ListAccountsForParentPages(input *organizations.ListAccountsForParentInput,
+	fn func(*organizations.ListAccountsForParentOutput, bool) bool) error {
+	fn(&organizations.ListAccountsForParentOutput{Accounts: f.accounts[*input.ParentId]}, true)
+	return nil
+}
+
+func (f *fakeOrg) ListChildrenPages(input *organizations.ListChildrenInput,
+	fn func(*organizations.ListChildrenOutput, bool) bool) error {
+	var children []*organizations.Child
+	for _, id := range f.children[*input.ParentId] {
+		children = append(children, &organizations.Child{Id: aws.String(id)})
+	}
+	fn(&organizations.ListChildrenOutput{Children: children}, true)
+	return nil
+}
+
+// fakeEC2 stands in for the EC2 API of a single account
+// and region. It only understands "tag:" filters.
+type fakeEC2 struct {
+	ec2iface.EC2API
+	vpcs    []*ec2.Vpc
+	subnets []*ec2.Subnet
+}
+
+func matchesTags(filters []*ec2.Filter, tags []*ec2.Tag) bool {
+	for _, filter := range filters {
+		if !strings.HasPrefix(*filter.Name, "tag:") {
+			continue
+		}
+		found := false
+		for _, tag := range tags {
+			if "tag:"+*tag.Key == *filter.Name && *tag.Value == *filter.Values[0] {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeEC2) DescribeVpcsPages(input *ec2.DescribeVpcsInput,
+	fn func(*ec2.DescribeVpcsOutput, bool) bool) error {
+	var vpcs []*ec2.Vpc
+	for _, vpc := range f.vpcs {
+		if matchesTags(input.Filters, vpc.Tags) {
+			vpcs = append(vpcs, vpc)
+		}
+	}
+	fn(&ec2.DescribeVpcsOutput{Vpcs: vpcs}, true)
+	return nil
+}
+
+func (f *fakeEC2) DescribeSubnetsPages(input *ec2.DescribeSubnetsInput,
+	fn func(*ec2.DescribeSubnetsOutput, bool) bool) error {
+	var vpcId string
+	for _, filter := range input.Filters {
+		if *filter.Name == "vpc-id" {
+			vpcId = *filter.Values[0]
+		}
+	}
+	var subnets []*ec2.Subnet
+	for _, subnet := range f.subnets {
+		if *subnet.VpcId == vpcId && matchesTags(input.Filters, subnet.Tags) {
+			subnets = append(subnets, subnet)
+		}
+	}
+	fn(&ec2.DescribeSubnetsOutput{Subnets: subnets}, true)
+	return nil
+}
+
+func tags(kv ...string) (tags []*ec2.Tag) {
+	for i := 0; i < len(kv); i += 2 {
+		tags = append(tags, &ec2.Tag{Key: aws.String(kv[i]), Value: aws.String(kv[i+1])})
+	}
+	return tags
+}
+
+func account(id, status string) *organizations.Account {
+	return &organizations.Account{Id: aws.String(id), Status: aws.String(status)}
+}
+
+func newTestDiscoverer(input *DiscoverInput) *discoverer {
+	org := &fakeOrg{
+		accounts: map[string][]*organizations.Account{
+			"ou-root":  {account("111111111111", "ACTIVE")},
+			"ou-child": {account("222222222222", "ACTIVE"), account("333333333333", "SUSPENDED")},
+			"ou-other": {account("444444444444", "ACTIVE")},
+		},
+		children: map[string][]string{
+			"ou-root": {"ou-child"},
+		},
+	}
+	accounts := map[string]*fakeEC2{
+		"111111111111": {
+			vpcs: []*ec2.Vpc{
+				{VpcId: aws.String("vpc-1"), Tags: tags("Env", "prod")},
+				{VpcId: aws.String("vpc-2"), Tags: tags("Env", "dev")},
+			},
+			subnets: []*ec2.Subnet{
+				{SubnetId: aws.String("subnet-1b"), VpcId: aws.String("vpc-1"), Tags: tags("Tier", "private")},
+				{SubnetId: aws.String("subnet-1a"), VpcId: aws.String("vpc-1"), Tags: tags("Tier", "private")},
+				{SubnetId: aws.String("subnet-1p"), VpcId: aws.String("vpc-1"), Tags: tags("Tier", "public")},
+				{SubnetId: aws.String("subnet-2a"), VpcId: aws.String("vpc-2"), Tags: tags("Tier", "private")},
+			},
+		},
+		"222222222222": {
+			vpcs: []*ec2.Vpc{
+				{VpcId: aws.String("vpc-3"), Tags: tags("Env", "prod")},
+			},
+			subnets: []*ec2.Subnet{
+				{SubnetId: aws.String("subnet-3p"), VpcId: aws.String("vpc-3"), Tags: tags("Tier", "public")},
+			},
+		},
+		"444444444444": {
+			vpcs: []*ec2.Vpc{
+				{VpcId: aws.String("vpc-4"), Tags: tags("Env", "prod")},
+			},
+			subnets: []*ec2.Subnet{
+				{SubnetId: aws.String("subnet-4a"), VpcId: aws.String("vpc-4"), Tags: tags("Tier", "private")},
+			},
+		},
+	}
+	input.Session = session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	return &discoverer{
+		input:  input,
+		orgSvc: org,
+		ec2For: func(target *Target) ec2iface.EC2API {
+			// the account is the only part of the role ARN
+			// the stand-ins care about
+			return accounts[strings.Split(target.RoleArn, ":")[4]]
+		},
+	}
+}
+
+func TestDiscoverOrganizationalUnit(t *testing.T) {
+	d := newTestDiscoverer(&DiscoverInput{
+		OrganizationalUnitId: "ou-root",
+		VpcTags:              map[string]string{"Env": "prod"},
+		SubnetTags:           map[string]string{"Tier": "private"},
+	})
+	targets, err := d.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// vpc-2 is dev, vpc-3 has no private subnets, 333333333333 is
+	// suspended and 444444444444 is outside of the OU
+	if len(targets) != 1 {
+		t.Fatalf("expected 1 target, got %d", len(targets))
+	}
+	target := targets[0]
+	if target.Context != "111111111111/us-east-1/vpc-1" {
+		t.Errorf("unexpected Context %q", target.Context)
+	}
+	if target.RoleArn != "arn:aws:iam::111111111111:role/"+DefaultDiscoverRoleName {
+		t.Errorf("unexpected RoleArn %q", target.RoleArn)
+	}
+	if strings.Join(target.SubnetIds, ",") != "subnet-1a,subnet-1b" {
+		t.Errorf("unexpected SubnetIds %v", target.SubnetIds)
+	}
+}
+
+func TestDiscoverOrganization(t *testing.T) {
+	d := newTestDiscoverer(&DiscoverInput{
+		RoleName: "fliptest",
+	})
+	targets, err := d.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contexts []string
+	for _, target := range targets {
+		contexts = append(contexts, target.Context)
+	}
+	expected := "111111111111/us-east-1/vpc-1,111111111111/us-east-1/vpc-2," +
+		"222222222222/us-east-1/vpc-3,444444444444/us-east-1/vpc-4"
+	if strings.Join(contexts, ",") != expected {
+		t.Errorf("unexpected targets %v", contexts)
+	}
+}
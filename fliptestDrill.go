@@ -0,0 +1,462 @@
+package fliptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// NatDrillInput provides all of the information necessary
+// to create a NatDrill object.
+type NatDrillInput struct {
+
+	// The input used to create the FlipTester for each drilled
+	// subnet. The VpcId is required. The stacks are retained
+	// for the whole drill and only deleted at the end if
+	// RetainStack is false. StackName can't be used since
+	// each subnet is tested from its own stack.
+	TesterInput *FlipTesterInput
+
+	// The subnets to drill. Each subnet's route for
+	// DestinationCidrBlock must currently point at a
+	// NAT gateway.
+	// Default: TesterInput.SubnetIds or TesterInput.SubnetId
+	SubnetIds []string
+
+	// The NAT gateways to fail over to. Only gateways in a
+	// different availability zone from the drilled subnet's
+	// current NAT gateway are used.
+	// Default: every available NAT gateway in the VPC
+	NatGatewayIds []string
+
+	// The destination of the route to fail over.
+	// Default: "0.0.0.0/0"
+	DestinationCidrBlock string
+
+	// How long to wait (in seconds) after replacing
+	// the route before running the drill tests.
+	// Default: 10 Seconds
+	SettleTimeSeconds int
+}
+
+// NewNatDrill returns an instance of NatDrill provided a prebuilt
+// NatDrillInput object. The .Run() method can then be called to
+// fail each subnet over to every other AZ's NAT gateway in turn.
+func NewNatDrill(input *NatDrillInput) (nd *NatDrill, err error) {
+	if input.TesterInput == nil {
+		err = errors.New("TesterInput is a required input field")
+		return nil, err
+	}
+	if input.TesterInput.VpcId == "" {
+		err = errors.New("TesterInput.VpcId is a required input field")
+		return nil, err
+	}
+	if input.TesterInput.StackName != "" {
+		err = errors.New("StackName can not be used with NewNatDrill")
+		return nil, err
+	}
+	if len(input.SubnetIds) < 1 {
+		input.SubnetIds = input.TesterInput.SubnetIds
+	}
+	if len(input.SubnetIds) < 1 {
+		if input.TesterInput.SubnetId == "" {
+			err = errors.New("SubnetIds or TesterInput.SubnetId is required")
+			return nil, err
+		}
+		input.SubnetIds = []string{input.TesterInput.SubnetId}
+	}
+	if input.DestinationCidrBlock == "" {
+		input.DestinationCidrBlock = defaultDestinationCidrBlock
+	}
+	if input.TesterInput.RunId == "" {
+		// one run ID for every subnet's stack
+		input.TesterInput.RunId = newRunId()
+	}
+	if input.SettleTimeSeconds == 0 {
+		input.SettleTimeSeconds = 10
+	}
+	if input.TesterInput.Session == nil {
+		input.TesterInput.Session, err = session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	nd = &NatDrill{
+		Testers:     make(map[string]*FlipTester),
+		input:       input,
+		runTests:    (*FlipTester).Test,
+		ec2Svc:      ec2.New(input.TesterInput.Session),
+		retainStack: input.TesterInput.RetainStack,
+	}
+	return nd, nil
+}
+
+// NatDrill temporarily points subnets' default routes at other
+// availability zones' NAT gateways and tests egress through them.
+type NatDrill struct {
+	// One report per drilled subnet and NAT gateway pair.
+	// Populated as the .Run() method progresses.
+	Reports []*NatDrillReport
+
+	// The FlipTesters used for each subnet keyed by SubnetId.
+	Testers map[string]*FlipTester
+
+	input       *NatDrillInput
+	runTests    func(*FlipTester) error // runs a subnet's suite; .Test() outside of tests
+	ec2Svc      ec2iface.EC2API
+	retainStack bool            // whether to keep the stacks after the drill
+	drillNats   map[string]bool // the NAT gateways that may be failed over to
+}
+
+// NatDrillReport holds the outcome of failing one subnet over to
+// one NAT gateway in another availability zone.
+type NatDrillReport struct {
+	SubnetId                    string
+	SubnetAvailabilityZone      string
+	RouteTableId                string
+	OriginalNatGatewayId        string
+	OriginalNatAvailabilityZone string
+	DrillNatGatewayId           string
+	DrillNatAvailabilityZone    string
+
+	BaselineResults []*TestResult
+	BaselinePassed  bool
+	DrillResults    []*TestResult
+	DrillPassed     bool
+
+	// Names of the tests that passed on the original
+	// NAT gateway but failed on the drill NAT gateway.
+	Regressions []string
+
+	// The difference in total elapsed time of all tests
+	// between the drill and the baseline (in seconds).
+	ElapsedTimeDeltaS float64
+
+	// Whether or not the original route was put back.
+	Restored bool
+
+	// Any error that ended this drill early.
+	Error string
+
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// Run performs the drill and is equivalent to calling RunWithContext
+// with context.Background().
+func (nd *NatDrill) Run() error {
+	return nd.RunWithContext(context.Background())
+}
+
+// RunWithContext runs a baseline for every subnet and then, for each
+// NAT gateway in another availability zone, points the subnet's route
+// at that gateway, runs the suite and restores the original route.
+// The route is restored when the drill errors or ctx is cancelled.
+// Cancellation is checked between steps so a test pass that is
+// already running will finish first.
+func (nd *NatDrill) RunWithContext(ctx context.Context) (err error) {
+	nats, err := nd.getNatGateways()
+	if err != nil {
+		return err
+	}
+	subnetAzs, err := subnetAvailabilityZones(nd.ec2Svc, nd.input.SubnetIds)
+	if err != nil {
+		return err
+	}
+	defer nd.cleanup()
+	var failed []string
+	for _, subnetId := range nd.input.SubnetIds {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		err = nd.drillSubnet(ctx, subnetId, subnetAzs[subnetId], nats)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", subnetId, err.Error()))
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	for _, report := range nd.Reports {
+		if len(report.Regressions) > 0 {
+			failed = append(failed, fmt.Sprintf("%s via %s regressed: %s",
+				report.SubnetId, report.DrillNatGatewayId,
+				strings.Join(report.Regressions, ", "),
+			))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("nat drill failed: " + strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// drillSubnet runs the baseline for one subnet and then drills it
+// against every NAT gateway in a different availability zone.
+func (nd *NatDrill) drillSubnet(ctx context.Context, subnetId, subnetAz string, nats map[string]string) error {
+	tableId, err := subnetRouteTableId(nd.ec2Svc, nd.input.TesterInput.VpcId, subnetId)
+	if err != nil {
+		return err
+	}
+	route, _, err := getRoute(nd.ec2Svc, tableId, nd.input.DestinationCidrBlock)
+	if err != nil {
+		return err
+	}
+	originalNat := aws.StringValue(route.NatGatewayId)
+	if originalNat == "" {
+		return fmt.Errorf("route '%s' in '%s' does not target a NAT gateway",
+			nd.input.DestinationCidrBlock, tableId,
+		)
+	}
+	testerInput := *nd.input.TesterInput
+	testerInput.SubnetId = subnetId
+	testerInput.RetainStack = true
+	ft, err := New(&testerInput)
+	if err != nil {
+		return err
+	}
+	nd.Testers[subnetId] = ft
+	msg := fmt.Sprintf("running baseline tests via '%s'", originalNat)
+	ft.logMessage(msg)
+	testErr := nd.runTests(ft)
+	baseline := ft.TestResults
+	baselinePassed := ft.Passed
+	if len(baseline) < 1 {
+		if testErr != nil {
+			return testErr
+		}
+		return errors.New("no baseline results")
+	}
+	var natIds []string
+	for natId := range nats {
+		natIds = append(natIds, natId)
+	}
+	sort.Strings(natIds)
+	for _, natId := range natIds {
+		natAz := nats[natId]
+		if natAz == nats[originalNat] || !nd.drillNats[natId] {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		report := &NatDrillReport{
+			SubnetId:                    subnetId,
+			SubnetAvailabilityZone:      subnetAz,
+			RouteTableId:                tableId,
+			OriginalNatGatewayId:        originalNat,
+			OriginalNatAvailabilityZone: nats[originalNat],
+			DrillNatGatewayId:           natId,
+			DrillNatAvailabilityZone:    natAz,
+			BaselineResults:             baseline,
+			BaselinePassed:              baselinePassed,
+		}
+		nd.Reports = append(nd.Reports, report)
+		err = nd.drillPair(ctx, ft, report)
+		if err != nil {
+			report.Error = err.Error()
+			if !report.Restored {
+				// the route may be pointing somewhere it shouldn't
+				// so stop drilling this subnet
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// drillPair flips one subnet's route to the report's drill NAT
+// gateway, tests and always attempts to put the route back.
+func (nd *NatDrill) drillPair(ctx context.Context, ft *FlipTester, report *NatDrillReport) (err error) {
+	report.StartTime = time.Now()
+	cidr := nd.input.DestinationCidrBlock
+	original := &RouteTarget{NatGatewayId: report.OriginalNatGatewayId}
+	drill := &RouteTarget{NatGatewayId: report.DrillNatGatewayId}
+	msg := fmt.Sprintf("drilling '%s' (%s) via '%s' (%s)",
+		report.SubnetId, report.SubnetAvailabilityZone,
+		report.DrillNatGatewayId, report.DrillNatAvailabilityZone,
+	)
+	ft.logMessage(msg)
+	err = replaceRoute(nd.ec2Svc, report.RouteTableId, cidr, drill)
+	if err != nil {
+		report.Restored = true
+		report.EndTime = time.Now()
+		return err
+	}
+	defer func() {
+		// always put the route back, even on panic or cancellation
+		msg := fmt.Sprintf("restoring route to '%s'", report.OriginalNatGatewayId)
+		ft.logMessage(msg)
+		restoreErr := replaceRoute(nd.ec2Svc, report.RouteTableId, cidr, original)
+		if restoreErr != nil {
+			msg = fmt.Sprintf("restore failed: %s", restoreErr.Error())
+			ft.logMessage(msg)
+			err = errors.New(msg)
+		} else {
+			report.Restored = true
+		}
+		report.EndTime = time.Now()
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Second * time.Duration(nd.input.SettleTimeSeconds)):
+	}
+	testErr := nd.runTests(ft)
+	report.DrillResults = ft.TestResults
+	report.DrillPassed = ft.Passed
+	report.Regressions = regressions(report.BaselineResults, report.DrillResults)
+	if len(report.DrillResults) < 1 && testErr != nil {
+		report.Regressions = append(report.Regressions, "no results: "+testErr.Error())
+	}
+	report.ElapsedTimeDeltaS = totalElapsedTimeS(report.DrillResults) -
+		totalElapsedTimeS(report.BaselineResults)
+	return ctx.Err()
+}
+
+// cleanup deletes the drill stacks unless they're being retained.
+func (nd *NatDrill) cleanup() {
+	if nd.retainStack {
+		return
+	}
+	for _, ft := range nd.Testers {
+		if !ft.stackCreated {
+			continue
+		}
+		msg := "deleting stack"
+		ft.logMessage(msg)
+		err := ft.removeStack()
+		if err != nil {
+			msg = fmt.Sprintf("errors: %s", err.Error())
+			ft.logMessage(msg)
+		}
+	}
+}
+
+// GetLog returns a string representing the log messages
+// from all of the drill's FlipTesters.
+func (nd *NatDrill) GetLog() string {
+	var logs []string
+	for _, subnetId := range nd.input.SubnetIds {
+		if ft, ok := nd.Testers[subnetId]; ok {
+			logs = append(logs, ft.GetLog())
+		}
+	}
+	return strings.Join(logs, "\n")
+}
+
+// getNatGateways returns the drill's NAT gateways mapped to
+// their availability zones.
+func (nd *NatDrill) getNatGateways() (map[string]string, error) {
+	input := &ec2.DescribeNatGatewaysInput{
+		Filter: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []*string{aws.String(nd.input.TesterInput.VpcId)},
+			},
+			{
+				Name:   aws.String("state"),
+				Values: []*string{aws.String("available")},
+			},
+		},
+	}
+	natSubnets := make(map[string]string)
+	var subnetIds []string
+	err := nd.ec2Svc.DescribeNatGatewaysPages(input,
+		func(page *ec2.DescribeNatGatewaysOutput, lastPage bool) bool {
+			for _, nat := range page.NatGateways {
+				natSubnets[*nat.NatGatewayId] = *nat.SubnetId
+				subnetIds = append(subnetIds, *nat.SubnetId)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(natSubnets) < 2 {
+		return nil, errors.New("a nat drill needs at least two available NAT gateways in the VPC")
+	}
+	azs, err := subnetAvailabilityZones(nd.ec2Svc, subnetIds)
+	if err != nil {
+		return nil, err
+	}
+	// all of the gateways are returned since the subnets'
+	// current gateways are needed to know which AZ they're
+	// failing over from
+	nats := make(map[string]string)
+	nd.drillNats = make(map[string]bool)
+	for natId, subnetId := range natSubnets {
+		nats[natId] = azs[subnetId]
+		nd.drillNats[natId] = len(nd.input.NatGatewayIds) < 1
+	}
+	for _, natId := range nd.input.NatGatewayIds {
+		if _, ok := nats[natId]; !ok {
+			return nil, fmt.Errorf("NAT gateway '%s' is not available in the VPC", natId)
+		}
+		nd.drillNats[natId] = true
+	}
+	return nats, nil
+}
+
+// subnetAvailabilityZones maps each of the given subnets
+// to its availability zone.
+func subnetAvailabilityZones(svc ec2iface.EC2API, subnetIds []string) (map[string]string, error) {
+	azs := make(map[string]string)
+	response, err := svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice(subnetIds),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, subnet := range response.Subnets {
+		azs[*subnet.SubnetId] = *subnet.AvailabilityZone
+	}
+	return azs, nil
+}
+
+// subnetRouteTableId returns the route table explicitly associated
+// with the subnet or the VPC's main route table if there isn't one.
+func subnetRouteTableId(svc ec2iface.EC2API, vpcId, subnetId string) (string, error) {
+	for _, filter := range []*ec2.Filter{
+		{
+			Name:   aws.String("association.subnet-id"),
+			Values: []*string{aws.String(subnetId)},
+		},
+		{
+			Name:   aws.String("association.main"),
+			Values: []*string{aws.String("true")},
+		},
+	} {
+		response, err := svc.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("vpc-id"),
+					Values: []*string{aws.String(vpcId)},
+				},
+				filter,
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(response.RouteTables) > 0 {
+			return *response.RouteTables[0].RouteTableId, nil
+		}
+	}
+	return "", fmt.Errorf("could not find a route table for subnet '%s'", subnetId)
+}
+
+func totalElapsedTimeS(results []*TestResult) (total float64) {
+	for _, result := range results {
+		total += result.ElapsedTimeS
+	}
+	return total
+}
@@ -0,0 +1,89 @@
+package fliptest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// newTestDrill returns a NatDrill whose test runs call run
+// with the tester, drilling subnet-1's route from nat-1 to
+// nat-2.
+func newTestDrill(svc *fakeRouteEC2, run func(ft *FlipTester) error) (*NatDrill, *NatDrillReport) {
+	nd := &NatDrill{
+		input: &NatDrillInput{
+			TesterInput:          &FlipTesterInput{},
+			DestinationCidrBlock: defaultDestinationCidrBlock,
+		},
+		runTests: run,
+		ec2Svc:   svc,
+	}
+	report := &NatDrillReport{
+		SubnetId:             "subnet-1",
+		RouteTableId:         "rtb-1",
+		OriginalNatGatewayId: "nat-1",
+		DrillNatGatewayId:    "nat-2",
+		BaselineResults:      passing("a"),
+	}
+	return nd, report
+}
+
+func TestNewNatDrillRejectsStackName(t *testing.T) {
+	_, err := NewNatDrill(&NatDrillInput{
+		TesterInput: &FlipTesterInput{VpcId: "vpc-1", SubnetId: "subnet-1", StackName: "fliptest-1"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "StackName") {
+		t.Errorf("got error %v, want StackName rejected", err)
+	}
+}
+
+func TestDrillRestoresRouteAfterTestError(t *testing.T) {
+	svc := &fakeRouteEC2{route: natRoute()}
+	nd, report := newTestDrill(svc, func(ft *FlipTester) error {
+		ft.TestResults = nil
+		return errors.New("invoke failed")
+	})
+	err := nd.drillPair(context.Background(), &FlipTester{}, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(svc.replaced, ",") != "nat-2,nat-1" || !report.Restored {
+		t.Errorf("got replacements %v, want the drill and a restore to nat-1", svc.replaced)
+	}
+	if len(report.Regressions) != 2 {
+		t.Errorf("got regressions %v, want the failed test and the error", report.Regressions)
+	}
+}
+
+func TestDrillRestoresRouteWhenCancelled(t *testing.T) {
+	svc := &fakeRouteEC2{route: natRoute()}
+	ctx, cancel := context.WithCancel(context.Background())
+	nd, report := newTestDrill(svc, func(ft *FlipTester) error {
+		// cancelled while the drill tests run
+		cancel()
+		ft.TestResults = passing("a")
+		return nil
+	})
+	err := nd.drillPair(ctx, &FlipTester{}, report)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want the cancellation", err)
+	}
+	if aws.StringValue(svc.route.NatGatewayId) != "nat-1" || !report.Restored {
+		t.Errorf("route targets %v, want it restored to nat-1", svc.route)
+	}
+}
+
+func TestDrillReportsFailedRestore(t *testing.T) {
+	svc := &fakeRouteEC2{route: natRoute(), fail: map[int]bool{2: true}}
+	nd, report := newTestDrill(svc, func(ft *FlipTester) error {
+		ft.TestResults = passing("a")
+		return nil
+	})
+	err := nd.drillPair(context.Background(), &FlipTester{}, report)
+	if err == nil || !strings.Contains(err.Error(), "restore failed") || report.Restored {
+		t.Errorf("got error %v and Restored %t, want the restore to fail", err, report.Restored)
+	}
+}
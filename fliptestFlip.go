@@ -0,0 +1,304 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// RouteFlipInput provides all of the information necessary
+// to create a RouteFlipper object.
+type RouteFlipInput struct {
+
+	// The input used to create the FlipTester that runs
+	// the suite before and after the flip. Its SubnetId
+	// should be a subnet that uses RouteTableId so that
+	// the tests actually travel the flipped route. The
+	// stack is retained between the two runs and is only
+	// deleted at the end if RetainStack is false.
+	TesterInput *FlipTesterInput
+
+	// The route table containing the route to flip.
+	RouteTableId string
+
+	// The destination of the route to flip.
+	// Default: "0.0.0.0/0"
+	DestinationCidrBlock string
+
+	// Where the route should point after the flip
+	// e.g. a new NAT gateway, transit gateway or
+	// firewall endpoint.
+	NewTarget *RouteTarget
+
+	// Whether or not to leave the new route in place
+	// when the post-flip tests regress.
+	DisableRollback bool
+
+	// How long to wait (in seconds) after replacing
+	// the route before running the post-flip tests.
+	// Default: 10 Seconds
+	SettleTimeSeconds int
+}
+
+// NewRouteFlipper returns an instance of RouteFlipper provided a
+// prebuilt RouteFlipInput object. The .Flip() method can then be
+// called to run the baseline tests, flip the route, run the tests
+// again and roll back the route if the results regress.
+func NewRouteFlipper(input *RouteFlipInput) (rf *RouteFlipper, err error) {
+	if input.TesterInput == nil {
+		err = errors.New("TesterInput is a required input field")
+		return nil, err
+	}
+	if input.RouteTableId == "" {
+		err = errors.New("RouteTableId is a required input field")
+		return nil, err
+	}
+	if input.NewTarget == nil {
+		err = errors.New("NewTarget is a required input field")
+		return nil, err
+	}
+	err = input.NewTarget.validate()
+	if err != nil {
+		return nil, err
+	}
+	if input.DestinationCidrBlock == "" {
+		input.DestinationCidrBlock = defaultDestinationCidrBlock
+	}
+	if input.SettleTimeSeconds == 0 {
+		input.SettleTimeSeconds = 10
+	}
+	// the stack has to survive the baseline run so
+	// it's always retained and cleaned up by Flip()
+	retainStack := input.TesterInput.RetainStack
+	input.TesterInput.RetainStack = true
+	tester, err := New(input.TesterInput)
+	input.TesterInput.RetainStack = retainStack
+	if err != nil {
+		return nil, err
+	}
+	rf = &RouteFlipper{
+		Tester:            tester,
+		runTests:          tester.Test,
+		ec2Svc:            ec2.New(tester.sess),
+		retainStack:       retainStack,
+		disableRollback:   input.DisableRollback,
+		settleTimeSeconds: input.SettleTimeSeconds,
+		Result: &RouteFlipResult{
+			RouteTableId:         input.RouteTableId,
+			DestinationCidrBlock: input.DestinationCidrBlock,
+			NewTarget:            input.NewTarget,
+		},
+	}
+	return rf, nil
+}
+
+// RouteFlipper runs a test suite before and after changing a route
+// and puts the original route back if the change makes things worse.
+type RouteFlipper struct {
+	// The FlipTester used to run both test passes. Its
+	// log contains the messages from the whole flip.
+	Tester *FlipTester
+
+	// The full record of the flip. Populated as the
+	// .Flip() method progresses.
+	Result *RouteFlipResult
+
+	runTests          func() error // runs the suite; tester.Test outside of tests
+	ec2Svc            ec2iface.EC2API
+	retainStack       bool // whether to keep the stack after the flip
+	disableRollback   bool // whether to leave a regressed route in place
+	settleTimeSeconds int  // how long after flipping to wait before testing
+}
+
+// RouteFlipResult holds the before and after routes and test results
+// of a route flip.
+type RouteFlipResult struct {
+	RouteTableId         string
+	DestinationCidrBlock string
+
+	// Where the route pointed before the flip.
+	OriginalTarget *RouteTarget
+
+	// Where the route pointed after the flip.
+	NewTarget *RouteTarget
+
+	BaselineResults []*TestResult
+	BaselinePassed  bool
+	PostFlipResults []*TestResult
+	PostFlipPassed  bool
+
+	// Names of the tests that passed before the flip
+	// but failed after it.
+	Regressions []string
+
+	// Whether or not the route was put back to
+	// OriginalTarget after a regression.
+	RolledBack bool
+
+	StartTime    time.Time
+	FlipTime     time.Time
+	RollbackTime time.Time
+	EndTime      time.Time
+}
+
+// Flip runs the test suite on the current route as a baseline, replaces
+// the route with the new target, runs the suite again and restores the
+// original route if any test that passed before the flip fails after it.
+// An error is returned if the flip could not be performed or if it was
+// rolled back.
+func (rf *RouteFlipper) Flip() (err error) {
+	ft := rf.Tester
+	res := rf.Result
+	res.StartTime = time.Now()
+	defer func() {
+		res.EndTime = time.Now()
+	}()
+	route, table, err := getRoute(rf.ec2Svc, res.RouteTableId, res.DestinationCidrBlock)
+	if err != nil {
+		return err
+	}
+	res.OriginalTarget = routeTargetFromRoute(route)
+	if res.OriginalTarget.validate() != nil {
+		// e.g. a local or carrier gateway, which a rollback
+		// couldn't put back
+		err = fmt.Errorf("route '%s' in '%s' targets something that can't be restored; not flipping it",
+			res.DestinationCidrBlock, res.RouteTableId,
+		)
+		ft.logMessage(err.Error())
+		return err
+	}
+	msg := fmt.Sprintf("route '%s' in '%s' currently targets '%s'",
+		res.DestinationCidrBlock, res.RouteTableId, res.OriginalTarget,
+	)
+	ft.logMessage(msg)
+	if ft.subnetId != "" && !routeTableHasSubnet(table, ft.subnetId) {
+		msg = fmt.Sprintf("warning: subnet '%s' is not explicitly associated with '%s'",
+			ft.subnetId, res.RouteTableId,
+		)
+		ft.logMessage(msg)
+	}
+
+	msg = "running baseline tests"
+	ft.logMessage(msg)
+	err = rf.runTests()
+	res.BaselineResults = ft.TestResults
+	res.BaselinePassed = ft.Passed
+	if len(res.BaselineResults) < 1 {
+		// nothing to compare against so don't touch the route
+		msg = "no baseline results, aborting flip"
+		ft.logMessage(msg)
+		return rf.cleanup(err)
+	}
+
+	msg = fmt.Sprintf("flipping route to '%s'", res.NewTarget)
+	ft.logMessage(msg)
+	err = replaceRoute(rf.ec2Svc, res.RouteTableId, res.DestinationCidrBlock, res.NewTarget)
+	if err != nil {
+		return rf.cleanup(err)
+	}
+	res.FlipTime = time.Now()
+	msg = fmt.Sprintf("sleeping %d seconds for route to settle", rf.settleTimeSeconds)
+	ft.logMessage(msg)
+	time.Sleep(time.Second * time.Duration(rf.settleTimeSeconds))
+
+	msg = "running post-flip tests"
+	ft.logMessage(msg)
+	testErr := rf.runTests()
+	res.PostFlipResults = ft.TestResults
+	res.PostFlipPassed = ft.Passed
+	res.Regressions = regressions(res.BaselineResults, res.PostFlipResults)
+	if len(res.PostFlipResults) < 1 && testErr != nil {
+		res.Regressions = append(res.Regressions, "no results: "+testErr.Error())
+	}
+	if len(res.Regressions) < 1 {
+		msg = "no regressions detected, keeping new route"
+		ft.logMessage(msg)
+		return rf.cleanup(nil)
+	}
+	msg = fmt.Sprintf("regressions detected: %s", strings.Join(res.Regressions, ", "))
+	ft.logMessage(msg)
+	if rf.disableRollback {
+		msg = "rollback disabled, keeping new route"
+		ft.logMessage(msg)
+		return rf.cleanup(errors.New(msg))
+	}
+
+	msg = fmt.Sprintf("rolling back route to '%s'", res.OriginalTarget)
+	ft.logMessage(msg)
+	err = replaceRoute(rf.ec2Svc, res.RouteTableId, res.DestinationCidrBlock, res.OriginalTarget)
+	if err != nil {
+		msg = fmt.Sprintf("rollback failed: %s", err.Error())
+		ft.logMessage(msg)
+		return rf.cleanup(errors.New(msg))
+	}
+	res.RolledBack = true
+	res.RollbackTime = time.Now()
+	err = fmt.Errorf("route flip regressed and was rolled back: %s",
+		strings.Join(res.Regressions, ", "),
+	)
+	return rf.cleanup(err)
+}
+
+// cleanup deletes the stack unless it's being retained and
+// returns the error that ended the flip.
+func (rf *RouteFlipper) cleanup(flipErr error) error {
+	ft := rf.Tester
+	if !rf.retainStack && ft.stackCreated {
+		msg := "deleting stack"
+		ft.logMessage(msg)
+		err := ft.removeStack()
+		if err != nil && flipErr == nil {
+			flipErr = err
+		}
+	}
+	if flipErr != nil {
+		msg := fmt.Sprintf("errors: %s", flipErr.Error())
+		ft.logMessage(msg)
+	}
+	return flipErr
+}
+
+// GetLog returns a string representing the log messages
+// from the life of the RouteFlipper object.
+func (rf *RouteFlipper) GetLog() string {
+	return rf.Tester.GetLog()
+}
+
+func routeTableHasSubnet(table *ec2.RouteTable, subnetId string) bool {
+	for _, assoc := range table.Associations {
+		if aws.StringValue(assoc.SubnetId) == subnetId {
+			return true
+		}
+	}
+	return false
+}
+
+// testKey identifies a test across runs using its
+// Name if it has one and its Url otherwise.
+func testKey(result *TestResult) string {
+	if result.Name != "" {
+		return result.Name
+	}
+	return result.Url
+}
+
+// regressions returns the keys of the tests that passed
+// in before but didn't pass (or didn't run) in after.
+func regressions(before, after []*TestResult) (regressed []string) {
+	passedAfter := make(map[string]bool)
+	for _, result := range after {
+		passedAfter[testKey(result)] = resultPassed(result)
+	}
+	for _, result := range before {
+		key := testKey(result)
+		if resultPassed(result) && !passedAfter[key] {
+			regressed = append(regressed, key)
+		}
+	}
+	return regressed
+}
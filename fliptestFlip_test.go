@@ -0,0 +1,149 @@
+package fliptest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeRouteEC2 stands in for the EC2 API with a single route
+// table holding one route. Replacements are recorded and
+// applied; the ones numbered in fail (from 1) return an
+// error instead.
+type fakeRouteEC2 struct {
+	ec2iface.EC2API
+	route    *ec2.Route
+	replaced []string
+	fail     map[int]bool
+}
+
+func (f *fakeRouteEC2) DescribeRouteTables(input *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	return &ec2.DescribeRouteTablesOutput{RouteTables: []*ec2.RouteTable{
+		{
+			RouteTableId: input.RouteTableIds[0],
+			Routes:       []*ec2.Route{f.route},
+		},
+	}}, nil
+}
+
+func (f *fakeRouteEC2) ReplaceRoute(input *ec2.ReplaceRouteInput) (*ec2.ReplaceRouteOutput, error) {
+	if f.fail[len(f.replaced)+1] {
+		f.replaced = append(f.replaced, "failed")
+		return nil, errors.New("replace failed")
+	}
+	target := aws.StringValue(input.NatGatewayId) + aws.StringValue(input.GatewayId) +
+		aws.StringValue(input.TransitGatewayId)
+	f.replaced = append(f.replaced, target)
+	f.route = &ec2.Route{
+		DestinationCidrBlock: input.DestinationCidrBlock,
+		NatGatewayId:         input.NatGatewayId,
+		GatewayId:            input.GatewayId,
+		TransitGatewayId:     input.TransitGatewayId,
+	}
+	return &ec2.ReplaceRouteOutput{}, nil
+}
+
+// newTestFlipper returns a RouteFlipper whose test runs return
+// the given results in turn, flipping a NAT gateway route to a
+// transit gateway.
+func newTestFlipper(svc *fakeRouteEC2, runs ...[]*TestResult) *RouteFlipper {
+	ft := &FlipTester{}
+	run := 0
+	return &RouteFlipper{
+		Tester: ft,
+		runTests: func() error {
+			ft.TestResults = runs[run]
+			run++
+			return nil
+		},
+		ec2Svc:      svc,
+		retainStack: true,
+		Result: &RouteFlipResult{
+			RouteTableId:         "rtb-1",
+			DestinationCidrBlock: defaultDestinationCidrBlock,
+			NewTarget:            &RouteTarget{TransitGatewayId: "tgw-1"},
+		},
+	}
+}
+
+func natRoute() *ec2.Route {
+	return &ec2.Route{
+		DestinationCidrBlock: aws.String(defaultDestinationCidrBlock),
+		NatGatewayId:         aws.String("nat-1"),
+	}
+}
+
+func passing(names ...string) (results []*TestResult) {
+	for _, name := range names {
+		results = append(results, &TestResult{Name: name, Success: true})
+	}
+	return results
+}
+
+func TestRegressions(t *testing.T) {
+	before := append(passing("a", "b"), &TestResult{Name: "c"}, &TestResult{Url: "https://d"})
+	before[3].Success = true
+	after := append(passing("a"), &TestResult{Name: "b"}, &TestResult{Name: "c"})
+	got := strings.Join(regressions(before, after), ",")
+	if got != "b,https://d" {
+		t.Errorf("got regressions %s, want b,https://d", got)
+	}
+}
+
+func TestFlipKeepsRouteWithoutRegressions(t *testing.T) {
+	svc := &fakeRouteEC2{route: natRoute()}
+	rf := newTestFlipper(svc, passing("a", "b"), passing("a", "b"))
+	err := rf.Flip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(svc.replaced, ",") != "tgw-1" || rf.Result.RolledBack {
+		t.Errorf("got replacements %v, want only the flip", svc.replaced)
+	}
+}
+
+func TestFlipRollsBack(t *testing.T) {
+	svc := &fakeRouteEC2{route: natRoute()}
+	rf := newTestFlipper(svc, passing("a", "b"), append(passing("a"), &TestResult{Name: "b"}))
+	err := rf.Flip()
+	if err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Errorf("got error %v, want a rollback", err)
+	}
+	if strings.Join(svc.replaced, ",") != "tgw-1,nat-1" || !rf.Result.RolledBack {
+		t.Errorf("got replacements %v, want the flip and a rollback to nat-1", svc.replaced)
+	}
+	if aws.StringValue(svc.route.NatGatewayId) != "nat-1" {
+		t.Errorf("route targets %v, want nat-1", svc.route)
+	}
+}
+
+func TestFlipRollbackFails(t *testing.T) {
+	svc := &fakeRouteEC2{route: natRoute(), fail: map[int]bool{2: true}}
+	rf := newTestFlipper(svc, passing("a"), []*TestResult{{Name: "a"}})
+	err := rf.Flip()
+	if err == nil || !strings.Contains(err.Error(), "rollback failed") {
+		t.Errorf("got error %v, want the rollback to fail", err)
+	}
+	if rf.Result.RolledBack {
+		t.Error("want RolledBack false when the rollback failed")
+	}
+}
+
+func TestFlipRefusesUnrestorableRoute(t *testing.T) {
+	svc := &fakeRouteEC2{route: &ec2.Route{
+		DestinationCidrBlock: aws.String(defaultDestinationCidrBlock),
+		CarrierGatewayId:     aws.String("cagw-1"),
+	}}
+	rf := newTestFlipper(svc)
+	err := rf.Flip()
+	if err == nil || !strings.Contains(err.Error(), "can't be restored") {
+		t.Errorf("got error %v, want the flip refused", err)
+	}
+	if len(svc.replaced) > 0 {
+		t.Errorf("got replacements %v, want none", svc.replaced)
+	}
+}
@@ -0,0 +1,91 @@
+package fliptest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// Lambda allows 4KB of environment variables in total and
+// FLIPTEST_ENVIRONMENT's name uses some of it.
+const maxEnvironmentLength int = 4000
+
+// setFunctionOptions validates the lambda settings and
+// stores them on the FlipTester.
+func (ft *FlipTester) setFunctionOptions(input *FlipTesterInput) error {
+	custom := input.MemorySize != 0 || input.TimeoutSeconds != 0 || input.Architecture != "" ||
+		input.ReservedConcurrency != 0 || len(input.Environment) > 0 || input.KmsKeyArn != ""
+	if custom && input.StackTemplateFilename != "" {
+		return errors.New("MemorySize, TimeoutSeconds, Architecture, ReservedConcurrency, Environment " +
+			"and KmsKeyArn are only supported by the default template")
+	}
+	if input.MemorySize != 0 && (input.MemorySize < 128 || input.MemorySize > 10240) {
+		return fmt.Errorf("MemorySize must be between 128 and 10240, not %d", input.MemorySize)
+	}
+	if input.TimeoutSeconds != 0 && (input.TimeoutSeconds < 1 || input.TimeoutSeconds > 900) {
+		return fmt.Errorf("TimeoutSeconds must be between 1 and 900, not %d", input.TimeoutSeconds)
+	}
+	switch input.Architecture {
+	case "", lambda.ArchitectureX8664, lambda.ArchitectureArm64:
+	default:
+		return fmt.Errorf("Architecture must be '%s' or '%s', not '%s'",
+			lambda.ArchitectureX8664, lambda.ArchitectureArm64, input.Architecture,
+		)
+	}
+	if input.ReservedConcurrency < 0 {
+		return errors.New("ReservedConcurrency can't be negative")
+	}
+	if len(input.Environment) > 0 {
+		environment, err := json.Marshal(input.Environment)
+		if err != nil {
+			return err
+		}
+		if len(environment) > maxEnvironmentLength {
+			return fmt.Errorf("Environment is %d bytes as JSON, the maximum is %d",
+				len(environment), maxEnvironmentLength,
+			)
+		}
+		ft.environment = string(environment)
+	}
+	ft.memorySize = input.MemorySize
+	ft.timeoutSeconds = input.TimeoutSeconds
+	ft.architecture = input.Architecture
+	ft.reservedConcurrency = input.ReservedConcurrency
+	ft.kmsKeyArn = input.KmsKeyArn
+	return nil
+}
+
+// functionParameters returns the default template's
+// parameters for the lambda settings that are set.
+func (ft *FlipTester) functionParameters() (params []*cloudformation.Parameter) {
+	add := func(key, value string) {
+		params = append(params, &cloudformation.Parameter{
+			ParameterKey:   aws.String(key),
+			ParameterValue: aws.String(value),
+		})
+	}
+	if ft.memorySize != 0 {
+		add("MemorySize", strconv.Itoa(ft.memorySize))
+	}
+	if ft.timeoutSeconds != 0 {
+		add("Timeout", strconv.Itoa(ft.timeoutSeconds))
+	}
+	if ft.architecture != "" {
+		add("Architecture", ft.architecture)
+	}
+	if ft.reservedConcurrency != 0 {
+		add("ReservedConcurrency", strconv.Itoa(ft.reservedConcurrency))
+	}
+	if ft.environment != "" {
+		add("Environment", ft.environment)
+	}
+	if ft.kmsKeyArn != "" {
+		add("KmsKeyArn", ft.kmsKeyArn)
+	}
+	return params
+}
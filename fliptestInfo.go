@@ -0,0 +1,179 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// ProbeInfo describes the environment the lambda ran its tests
+// from. It is reported with every batch's RunMetadata and by .Info().
+type ProbeInfo struct {
+	// The lambda's network interface, looked up from the
+	// function's VPC configuration after the run.
+	PrivateIp        string
+	SubnetId         string
+	AvailabilityZone string
+
+	// The address the lambda sees for itself, which isn't
+	// the network interface's.
+	LocalIp string
+
+	// The nameservers in the lambda's /etc/resolv.conf.
+	Resolvers []string
+
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY in either
+	// case, as set by Environment.
+	Proxy map[string]string
+
+	Runtime string
+
+	// The function's configured timeout and memory, looked
+	// up with its network interface.
+	TimeoutSeconds int
+	MemorySize     int
+}
+
+func (pi *ProbeInfo) String() string {
+	var proxies []string
+	for _, key := range sortedKeys(pi.Proxy) {
+		proxies = append(proxies, key+"="+pi.Proxy[key])
+	}
+	return fmt.Sprintf("%s in %s (%s) resolvers=%s proxy=%s runtime=%s timeout=%ds memory=%dMB",
+		pi.PrivateIp, pi.SubnetId, pi.AvailabilityZone, strings.Join(pi.Resolvers, ","),
+		strings.Join(proxies, ","), pi.Runtime, pi.TimeoutSeconds, pi.MemorySize,
+	)
+}
+
+// Info invokes the lambda with the "Info" request type, which runs
+// no tests, and returns the environment it runs in. The stack must be
+// from template version 10 or later. The caller needs
+// lambda:GetFunctionConfiguration and ec2:DescribeNetworkInterfaces
+// to look up the network interface.
+func (ft *FlipTester) Info() (info *ProbeInfo, err error) {
+	err = ft.getStackInfo()
+	if err != nil {
+		return nil, err
+	}
+	svcL := lambda.New(ft.sess)
+	response, err := ft.invokeBatch(svcL, &lambdaEvent{
+		ProtocolVersion: ProtocolVersion,
+		RequestType:     "Info",
+		TestUrls:        []*TestUrl{},
+		RunId:           ft.RunId,
+		Batches:         1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Metadata.Probe == nil {
+		err = fmt.Errorf("lambda responded with protocol version %d, which has no Info request; "+
+			"upgrade the stack", response.ProtocolVersion,
+		)
+		return nil, err
+	}
+	ft.resolveProbes(svcL, []*RunMetadata{response.Metadata})
+	msg := "probe info: " + response.Metadata.Probe.String()
+	ft.logMessage(msg)
+	return response.Metadata.Probe, nil
+}
+
+// resolveProbes fills in the runtime, configuration and network
+// interface of each batch's probe. The configuration and interface
+// are looked up once per FlipTester and a failure to find them is
+// logged rather than failing the run.
+func (ft *FlipTester) resolveProbes(svc lambdaiface.LambdaAPI, metadata []*RunMetadata) {
+	var probes []*ProbeInfo
+	for _, m := range metadata {
+		if m != nil && m.Probe != nil {
+			m.Probe.Runtime = m.Runtime
+			probes = append(probes, m.Probe)
+		}
+	}
+	if len(probes) < 1 {
+		return
+	}
+	if ft.probeConfig == nil {
+		config, err := svc.GetFunctionConfiguration(&lambda.GetFunctionConfigurationInput{
+			FunctionName: &ft.functionName,
+		})
+		if err != nil {
+			msg := "couldn't look up the lambda's configuration: " + err.Error()
+			ft.logMessage(msg)
+			return
+		}
+		ft.probeConfig = config
+	}
+	for _, probe := range probes {
+		probe.TimeoutSeconds = int(aws.Int64Value(ft.probeConfig.Timeout))
+		probe.MemorySize = int(aws.Int64Value(ft.probeConfig.MemorySize))
+	}
+	if ft.probeInterface == nil {
+		eni, err := ft.functionInterface(ft.probeConfig)
+		if err != nil {
+			msg := "couldn't look up the lambda's network interface: " + err.Error()
+			ft.logMessage(msg)
+			return
+		}
+		ft.probeInterface = eni
+	}
+	for _, probe := range probes {
+		probe.PrivateIp = aws.StringValue(ft.probeInterface.PrivateIpAddress)
+		probe.SubnetId = aws.StringValue(ft.probeInterface.SubnetId)
+		probe.AvailabilityZone = aws.StringValue(ft.probeInterface.AvailabilityZone)
+	}
+}
+
+// functionInterface finds the lambda's network interface. Lambda
+// shares one interface between functions with the same subnet and
+// security groups and it isn't visible from inside the function, so
+// it's matched on those.
+func (ft *FlipTester) functionInterface(config *lambda.FunctionConfiguration) (*ec2.NetworkInterface, error) {
+	if config.VpcConfig == nil || len(config.VpcConfig.SubnetIds) < 1 {
+		return nil, errors.New("function isn't attached to a VPC")
+	}
+	response, err := ft.ec2Svc.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("interface-type"),
+				Values: []*string{aws.String("lambda")},
+			},
+			{
+				Name:   aws.String("subnet-id"),
+				Values: config.VpcConfig.SubnetIds,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	eni := matchingInterface(response.NetworkInterfaces, aws.StringValueSlice(config.VpcConfig.SecurityGroupIds))
+	if eni == nil {
+		return nil, errors.New("no network interface has the function's subnet and security groups")
+	}
+	return eni, nil
+}
+
+// matchingInterface returns the first interface whose security
+// groups are exactly groupIds.
+func matchingInterface(enis []*ec2.NetworkInterface, groupIds []string) *ec2.NetworkInterface {
+	want := append([]string(nil), groupIds...)
+	sort.Strings(want)
+	for _, eni := range enis {
+		var got []string
+		for _, group := range eni.Groups {
+			got = append(got, aws.StringValue(group.GroupId))
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") == strings.Join(want, ",") {
+			return eni
+		}
+	}
+	return nil
+}
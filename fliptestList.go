@@ -0,0 +1,169 @@
+package fliptest
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// ListInput provides all of the information necessary
+// to find stacks with List.
+type ListInput struct {
+
+	// The AWS session to use. Stacks are listed in the
+	// session's region. If no session is provided then
+	// one will be created using system defaults.
+	Session *session.Session
+
+	// Only stacks whose names start with this prefix are
+	// listed. If neither StackPrefix nor Tags are provided
+	// then DefaultStackPrefix is used.
+	StackPrefix string
+
+	// Only stacks that have all of these tags are listed.
+	// An empty value matches any value for that key.
+	Tags map[string]string
+}
+
+// StackSummary describes a fliptest stack found by List.
+type StackSummary struct {
+	StackName    string
+	StackId      string
+	StackStatus  string
+	StatusReason string
+
+	// The VPC and subnet the stack's lambda was
+	// launched in, from the stack's parameters.
+	VpcId    string
+	SubnetId string
+
+	// The name of the stack's test lambda, from the
+	// stack's outputs. Empty if the stack isn't complete.
+	FunctionName string
+
+	// The version of the template the stack was created
+	// from. "custom" if it was created from a
+	// StackTemplateFilename and empty if the stack
+	// predates template versioning.
+	TemplateVersion string
+
+	// The run that created the stack. Empty if the
+	// stack predates run IDs.
+	RunId string
+
+	CreationTime    time.Time
+	LastUpdatedTime time.Time
+
+	// When the stack will delete itself. Zero if it
+	// was created without a StackTTLHours.
+	ExpiresAt time.Time
+
+	// All of the stack's tags.
+	Tags map[string]string
+}
+
+// List returns the fliptest stacks in the session's region that match
+// the prefix and tags. The StackName of any of them can be passed as
+// FlipTesterInput.StackName to reuse the stack instead of creating one.
+func List(input *ListInput) (stacks []*StackSummary, err error) {
+	if input.Session == nil {
+		input.Session, err = session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	prefix := input.StackPrefix
+	if prefix == "" && len(input.Tags) < 1 {
+		prefix = DefaultStackPrefix
+	}
+	return listStacks(cloudformation.New(input.Session), prefix, input.Tags)
+}
+
+// listStacks describes every stack in the region and summarizes
+// the ones matching the prefix and tags.
+func listStacks(svc cloudformationiface.CloudFormationAPI, prefix string, tags map[string]string) (stacks []*StackSummary, err error) {
+	err = svc.DescribeStacksPages(&cloudformation.DescribeStacksInput{},
+		func(page *cloudformation.DescribeStacksOutput, lastPage bool) bool {
+			for _, stack := range page.Stacks {
+				if !strings.HasPrefix(*stack.StackName, prefix) || !stackHasTags(stack, tags) {
+					continue
+				}
+				stacks = append(stacks, summarizeStack(stack))
+			}
+			return true
+		})
+	return stacks, err
+}
+
+func summarizeStack(stack *cloudformation.Stack) *StackSummary {
+	summary := &StackSummary{
+		StackName:       aws.StringValue(stack.StackName),
+		StackId:         aws.StringValue(stack.StackId),
+		StackStatus:     aws.StringValue(stack.StackStatus),
+		StatusReason:    aws.StringValue(stack.StackStatusReason),
+		VpcId:           stackParameter(stack, "VpcId"),
+		SubnetId:        stackParameter(stack, "SubnetId"),
+		FunctionName:    stackOutput(stack, "FunctionName"),
+		TemplateVersion: stackTag(stack, tagTemplateVersion),
+		RunId:           stackTag(stack, tagRunId),
+		CreationTime:    aws.TimeValue(stack.CreationTime),
+		LastUpdatedTime: aws.TimeValue(stack.LastUpdatedTime),
+		Tags:            make(map[string]string),
+	}
+	for _, tag := range stack.Tags {
+		summary.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, summary.Tags[tagExpiresAt]); err == nil {
+		summary.ExpiresAt = expiresAt
+	}
+	return summary
+}
+
+// stackHasTags reports whether the stack has all of the tags. An
+// empty value only requires the key to be present.
+func stackHasTags(stack *cloudformation.Stack, tags map[string]string) bool {
+	for key, value := range tags {
+		found := false
+		for _, tag := range stack.Tags {
+			if aws.StringValue(tag.Key) == key && (value == "" || aws.StringValue(tag.Value) == value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func stackTag(stack *cloudformation.Stack, key string) string {
+	for _, tag := range stack.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+func stackParameter(stack *cloudformation.Stack, key string) string {
+	for _, param := range stack.Parameters {
+		if aws.StringValue(param.ParameterKey) == key {
+			return aws.StringValue(param.ParameterValue)
+		}
+	}
+	return ""
+}
+
+func stackOutput(stack *cloudformation.Stack, key string) string {
+	for _, output := range stack.Outputs {
+		if aws.StringValue(output.OutputKey) == key {
+			return aws.StringValue(output.OutputValue)
+		}
+	}
+	return ""
+}
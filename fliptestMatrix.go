@@ -0,0 +1,216 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// NewMatrix returns an instance of MatrixTester provided a prebuilt
+// FlipTesterInput object. The subnets to test are taken from
+// .SubnetIds or, if .AllSubnets or .SubnetTags are set, looked up
+// from the subnets in .VpcId. The .Test() method can then be called
+// to create a stack in every subnet in parallel, run the same suite
+// everywhere and populate .Matrix with the results.
+func NewMatrix(input *FlipTesterInput) (mt *MatrixTester, err error) {
+	if input.StackName != "" {
+		err = errors.New("StackName can not be used with NewMatrix")
+		return nil, err
+	}
+	if input.VpcId == "" {
+		err = errors.New("VpcId is a required input field")
+		return nil, err
+	}
+	if input.Session == nil {
+		input.Session, err = session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if input.MaxParallelStacks == 0 {
+		input.MaxParallelStacks = 10
+	}
+	if input.RunId == "" {
+		// one run ID for every subnet's stack
+		input.RunId = newRunId()
+	}
+	subnetIds := input.SubnetIds
+	if input.AllSubnets || len(input.SubnetTags) > 0 {
+		subnetIds, err = findSubnets(ec2.New(input.Session), input.VpcId, input.SubnetTags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(subnetIds) < 1 && input.SubnetId != "" {
+		subnetIds = []string{input.SubnetId}
+	}
+	if len(subnetIds) < 1 {
+		err = errors.New("no subnets to test; provide SubnetIds, AllSubnets or SubnetTags")
+		return nil, err
+	}
+	mt = &MatrixTester{
+		Testers: make(map[string]*FlipTester),
+		Matrix: &TestMatrix{
+			SubnetIds: subnetIds,
+			Results:   make(map[string]map[string]*TestResult),
+			Errors:    make(map[string]string),
+		},
+		maxParallelStacks: input.MaxParallelStacks,
+	}
+	for _, subnetId := range subnetIds {
+		testerInput := *input
+		testerInput.SubnetId = subnetId
+		testerInput.SubnetIds = nil
+		testerInput.AllSubnets = false
+		testerInput.SubnetTags = nil
+		ft, err := New(&testerInput)
+		if err != nil {
+			return nil, err
+		}
+		mt.Testers[subnetId] = ft
+	}
+	for _, test := range mt.Testers[subnetIds[0]].testEvent.TestUrls {
+		// the same key the results are stored under
+		mt.Matrix.TestNames = append(mt.Matrix.TestNames,
+			testKey(&TestResult{Name: test.Name, Url: test.Url}),
+		)
+	}
+	return mt, nil
+}
+
+// MatrixTester runs the same suite in several subnets at once.
+type MatrixTester struct {
+	// The FlipTester used for each subnet keyed by SubnetId.
+	Testers map[string]*FlipTester
+
+	// Stores the subnet by test results after the
+	// .Test() method has been called.
+	Matrix *TestMatrix
+
+	maxParallelStacks int // how many stacks to create at once
+}
+
+// TestMatrix holds the results of running the same suite in
+// several subnets.
+type TestMatrix struct {
+	// The tested subnets in the order they were provided
+	// or, if looked up from the VPC, sorted by ID.
+	SubnetIds []string
+
+	// The names of the tests in the order they were run.
+	// Tests without a Name are listed by their Url.
+	TestNames []string
+
+	// Results keyed by SubnetId and then by one of
+	// TestNames.
+	Results map[string]map[string]*TestResult
+
+	// Any error from testing a subnet keyed by SubnetId.
+	Errors map[string]string
+
+	// Indicates whether or not the tests passed
+	// in every subnet.
+	Passed bool
+}
+
+// Get returns the result of the named test in the
+// given subnet or nil if there isn't one.
+func (m *TestMatrix) Get(subnetId, testName string) *TestResult {
+	return m.Results[subnetId][testName]
+}
+
+// Test creates a stack in every subnet (no more than
+// MaxParallelStacks at a time), runs the suite in each and
+// populates .Matrix. An error is returned if any subnet failed.
+func (mt *MatrixTester) Test() (err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, mt.maxParallelStacks)
+	for _, subnetId := range mt.Matrix.SubnetIds {
+		wg.Add(1)
+		go func(subnetId string, ft *FlipTester) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			testErr := ft.Test()
+			results := make(map[string]*TestResult)
+			for _, result := range ft.TestResults {
+				results[testKey(result)] = result
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			mt.Matrix.Results[subnetId] = results
+			if testErr != nil {
+				mt.Matrix.Errors[subnetId] = testErr.Error()
+			}
+		}(subnetId, mt.Testers[subnetId])
+	}
+	wg.Wait()
+	mt.Matrix.Passed = len(mt.Matrix.Errors) < 1
+	if !mt.Matrix.Passed {
+		var failed []string
+		for _, subnetId := range mt.Matrix.SubnetIds {
+			if msg, ok := mt.Matrix.Errors[subnetId]; ok {
+				failed = append(failed, fmt.Sprintf("%s: %s", subnetId, msg))
+			}
+		}
+		err = errors.New("tests failed in some subnets: " + strings.Join(failed, "; "))
+	}
+	return err
+}
+
+// GetLog returns a string representing the log messages
+// from all of the matrix's FlipTesters.
+func (mt *MatrixTester) GetLog() string {
+	var logs []string
+	for _, subnetId := range mt.Matrix.SubnetIds {
+		logs = append(logs, mt.Testers[subnetId].GetLog())
+	}
+	return strings.Join(logs, "\n")
+}
+
+// findSubnets returns the IDs of the subnets in the VPC that
+// have all of the given tags, sorted by ID.
+func findSubnets(svc ec2iface.EC2API, vpcId string, tags map[string]string) (subnetIds []string, err error) {
+	input := &ec2.DescribeSubnetsInput{
+		Filters: append(tagFilters(tags), &ec2.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []*string{aws.String(vpcId)},
+		}),
+	}
+	err = svc.DescribeSubnetsPages(input,
+		func(page *ec2.DescribeSubnetsOutput, lastPage bool) bool {
+			for _, subnet := range page.Subnets {
+				subnetIds = append(subnetIds, *subnet.SubnetId)
+			}
+			return true
+		})
+	sort.Strings(subnetIds)
+	return subnetIds, err
+}
+
+// tagFilters converts a map of tags into EC2 describe filters.
+// An empty value only requires the key to be present.
+func tagFilters(tags map[string]string) (filters []*ec2.Filter) {
+	for key, value := range tags {
+		if value == "" {
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(key)},
+			})
+		} else {
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("tag:" + key),
+				Values: []*string{aws.String(value)},
+			})
+		}
+	}
+	return filters
+}
@@ -0,0 +1,324 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The number of free IP addresses the test lambda's
+// network interface needs in the subnet.
+const requiredFreeIps int64 = 1
+
+// TestPlan describes what .Test() would do without changing
+// anything in the account. It is returned by .Plan().
+type TestPlan struct {
+	// The stack that would be used. For a new stack
+	// without ReuseStack the random suffix is shown
+	// as "XXXXXXXX".
+	StackName string
+
+	// Whether or not a new stack would be created.
+	CreateStack bool
+
+	// The template version and the rendered template,
+	// parameters and tags the stack would be created
+	// with. Only populated when CreateStack is true.
+	TemplateVersion string
+	TemplateBody    string
+	Parameters      map[string]string
+	Tags            map[string]string
+
+	// The capabilities the template requires, as
+	// reported by ValidateTemplate.
+	Capabilities []string
+
+	// The resource types the template declares. Resources
+	// behind conditions that won't be met are included so
+	// this is an upper bound.
+	ResourceTypes []string
+
+	// The subnet the lambda would be launched in.
+	SubnetId             string
+	VpcId                string
+	AvailabilityZone     string
+	AvailableIpAddresses int64
+
+	// When the stack would delete itself if StackTTLHours
+	// was set. Zero otherwise.
+	ExpiresAt time.Time
+
+	// The steps .Test() would take, in order.
+	Steps []string
+
+	// Anything that would stop .Test() from succeeding.
+	Problems []string
+}
+
+// String renders the plan as a readable report.
+func (tp *TestPlan) String() string {
+	lines := []string{fmt.Sprintf("stack: %s", tp.StackName)}
+	if tp.CreateStack {
+		lines = append(lines, fmt.Sprintf("template version: %s", tp.TemplateVersion))
+		lines = append(lines, "parameters:")
+		for _, key := range sortedKeys(tp.Parameters) {
+			lines = append(lines, fmt.Sprintf("  %s = %s", key, tp.Parameters[key]))
+		}
+		lines = append(lines, "tags:")
+		for _, key := range sortedKeys(tp.Tags) {
+			lines = append(lines, fmt.Sprintf("  %s = %s", key, tp.Tags[key]))
+		}
+		lines = append(lines, fmt.Sprintf("capabilities: %s", strings.Join(tp.Capabilities, ", ")))
+		lines = append(lines, fmt.Sprintf("resource types: %s", strings.Join(tp.ResourceTypes, ", ")))
+	}
+	if tp.SubnetId != "" {
+		lines = append(lines, fmt.Sprintf("subnet: %s in %s (%s) with %d free IPs",
+			tp.SubnetId, tp.VpcId, tp.AvailabilityZone, tp.AvailableIpAddresses,
+		))
+	}
+	lines = append(lines, "steps:")
+	for i, step := range tp.Steps {
+		lines = append(lines, fmt.Sprintf("  %d. %s", i+1, step))
+	}
+	if len(tp.Problems) > 0 {
+		lines = append(lines, "problems:")
+		for _, problem := range tp.Problems {
+			lines = append(lines, "  - "+problem)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Plan works out what .Test() would do without creating, changing or
+// deleting anything. It renders the template, parameters and tags,
+// validates the template, checks that the subnet exists in the VPC
+// and has free IPs and lists the steps .Test() would take. The plan
+// is returned even if it found problems, in which case an error
+// listing them is returned as well.
+func (ft *FlipTester) Plan() (plan *TestPlan, err error) {
+	msg := "planning test"
+	ft.logMessage(msg)
+	plan = &TestPlan{
+		StackName: ft.StackName,
+		SubnetId:  ft.subnetId,
+		VpcId:     ft.vpcId,
+	}
+	if ft.stackCreated {
+		err = ft.planExistingStack(plan)
+	} else {
+		err = ft.planNewStack(plan)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if plan.CreateStack && ft.preflight {
+		missing, err := ft.Preflight()
+		if err != nil && len(missing) < 1 {
+			return nil, err
+		}
+		for _, m := range missing {
+			plan.Problems = append(plan.Problems, "missing permission: "+m)
+		}
+	}
+	if plan.SubnetId != "" {
+		err = ft.planSubnet(plan)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if plan.CreateStack {
+		ft.planSecurityGroups(plan)
+	}
+	plan.Steps = append(plan.Steps,
+		fmt.Sprintf("sleep %d seconds before calling the lambda", ft.initialSleepTimeSeconds),
+		fmt.Sprintf("sleep %d seconds then invoke the lambda with %d test URLs in %d batches",
+			ft.postEventSleepTimeSeconds, len(ft.testEvent.TestUrls),
+			len(batches(ft.testEvent.TestUrls, ft.batchSize)),
+		),
+		fmt.Sprintf("check that every test succeeded in under %.0f seconds", maxElapsedTimeS),
+	)
+	switch {
+	case ft.RetainStack:
+		plan.Steps = append(plan.Steps, "retain the stack")
+	case ft.waitForDelete:
+		plan.Steps = append(plan.Steps, fmt.Sprintf(
+			"delete the stack and wait for it to be deleted, retrying up to %d times", ft.deleteRetries,
+		))
+	default:
+		plan.Steps = append(plan.Steps, "delete the stack")
+	}
+	for _, problem := range plan.Problems {
+		ft.logMessage("plan problem: " + problem)
+	}
+	if len(plan.Problems) > 0 {
+		err = errors.New("plan found problems: " + strings.Join(plan.Problems, "; "))
+		return plan, err
+	}
+	msg = "plan complete"
+	ft.logMessage(msg)
+	return plan, nil
+}
+
+// planExistingStack fills in the plan for a stack that was
+// given by StackName or already created.
+func (ft *FlipTester) planExistingStack(plan *TestPlan) error {
+	response, err := ft.cfSvc.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: &ft.StackName,
+	})
+	if err != nil {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("could not describe stack: %s", err.Error()))
+		return nil
+	}
+	if len(response.Stacks) < 1 {
+		plan.Problems = append(plan.Problems, "could not find stack with provided StackName")
+		return nil
+	}
+	stack := summarizeStack(response.Stacks[0])
+	plan.TemplateVersion = stack.TemplateVersion
+	plan.SubnetId = stack.SubnetId
+	plan.VpcId = stack.VpcId
+	plan.ExpiresAt = stack.ExpiresAt
+	switch stack.StackStatus {
+	case cloudformation.StackStatusCreateComplete, cloudformation.StackStatusUpdateComplete:
+	default:
+		plan.Problems = append(plan.Problems, fmt.Sprintf("stack is in status %s", stack.StackStatus))
+	}
+	if stack.FunctionName == "" {
+		plan.Problems = append(plan.Problems, "stack has no FunctionName output")
+	}
+	plan.Steps = append(plan.Steps, fmt.Sprintf("use existing stack '%s'", stack.StackName))
+	if ft.resumed && !ft.versionChecked {
+		_, outdated, err := ft.CheckStackVersion()
+		if err != nil {
+			return err
+		}
+		if outdated && ft.upgradeStack {
+			plan.Steps = append(plan.Steps, fmt.Sprintf(
+				"upgrade the stack from template version '%s' to '%s' with a change set",
+				stack.TemplateVersion, TemplateVersion,
+			))
+		} else if outdated {
+			plan.Steps = append(plan.Steps, "warn that the stack's template is outdated")
+		}
+	}
+	return nil
+}
+
+// planNewStack fills in the plan for a stack that .Test()
+// would create or, with ReuseStack, find.
+func (ft *FlipTester) planNewStack(plan *TestPlan) error {
+	plan.StackName = ft.stackPrefix + "XXXXXXXX"
+	if ft.reuseStack {
+		stacks, err := listStacks(ft.cfSvc, ft.stackPrefix, ft.reuseTags())
+		if err != nil {
+			return err
+		}
+		for _, stack := range stacks {
+			healthy := stack.StackStatus == cloudformation.StackStatusCreateComplete ||
+				stack.StackStatus == cloudformation.StackStatusUpdateComplete
+			expiring := !stack.ExpiresAt.IsZero() && time.Until(stack.ExpiresAt) < reuseMinRemainingTTL
+			if healthy && !expiring {
+				plan.StackName = stack.StackName
+				plan.ExpiresAt = stack.ExpiresAt
+				plan.Steps = append(plan.Steps, fmt.Sprintf("reuse existing stack '%s'", stack.StackName))
+				return nil
+			}
+		}
+		plan.StackName = ft.sharedStackName()
+	}
+	plan.CreateStack = true
+	plan.TemplateVersion = ft.templateVersion()
+	templateBody, err := ft.getTemplateBody()
+	if err != nil {
+		return err
+	}
+	plan.TemplateBody = templateBody
+	if ft.stackTTLHours > 0 {
+		plan.ExpiresAt = stackExpiry(ft.stackTTLHours)
+	}
+	input := ft.createStackInput(plan.StackName, templateBody, nil, plan.ExpiresAt)
+	plan.Parameters = make(map[string]string)
+	for _, param := range input.Parameters {
+		plan.Parameters[aws.StringValue(param.ParameterKey)] = aws.StringValue(param.ParameterValue)
+	}
+	plan.Tags = make(map[string]string)
+	for _, tag := range input.Tags {
+		plan.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	validated, err := ft.cfSvc.ValidateTemplate(&cloudformation.ValidateTemplateInput{
+		TemplateBody: &templateBody,
+	})
+	if err != nil {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("template is invalid: %s", err.Error()))
+		return nil
+	}
+	plan.Capabilities = aws.StringValueSlice(validated.Capabilities)
+	declared := make(map[string]bool)
+	for _, param := range validated.Parameters {
+		declared[aws.StringValue(param.ParameterKey)] = true
+		if param.DefaultValue == nil && plan.Parameters[aws.StringValue(param.ParameterKey)] == "" {
+			plan.Problems = append(plan.Problems, fmt.Sprintf(
+				"template parameter '%s' has no default and no value", aws.StringValue(param.ParameterKey),
+			))
+		}
+	}
+	for key := range plan.Parameters {
+		if !declared[key] {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("template doesn't declare parameter '%s'", key))
+		}
+	}
+	summary, err := ft.cfSvc.GetTemplateSummary(&cloudformation.GetTemplateSummaryInput{
+		TemplateBody: &templateBody,
+	})
+	if err != nil {
+		return err
+	}
+	plan.ResourceTypes = aws.StringValueSlice(summary.ResourceTypes)
+	step := fmt.Sprintf("create stack '%s' with %d resource types and wait for it to complete",
+		plan.StackName, len(plan.ResourceTypes),
+	)
+	if !plan.ExpiresAt.IsZero() {
+		step += fmt.Sprintf("; it deletes itself at %s", plan.ExpiresAt.Format(time.RFC3339))
+	}
+	plan.Steps = append(plan.Steps, step)
+	return nil
+}
+
+// planSubnet checks that the plan's subnet exists in its
+// VPC and has room for the lambda's network interface.
+func (ft *FlipTester) planSubnet(plan *TestPlan) error {
+	response, err := ft.ec2Svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{aws.String(plan.SubnetId)},
+	})
+	if err != nil || len(response.Subnets) < 1 {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("subnet '%s' was not found", plan.SubnetId))
+		return nil
+	}
+	subnet := response.Subnets[0]
+	plan.AvailabilityZone = aws.StringValue(subnet.AvailabilityZone)
+	plan.AvailableIpAddresses = aws.Int64Value(subnet.AvailableIpAddressCount)
+	if aws.StringValue(subnet.VpcId) != plan.VpcId {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("subnet '%s' belongs to '%s' not '%s'",
+			plan.SubnetId, aws.StringValue(subnet.VpcId), plan.VpcId,
+		))
+	}
+	if plan.CreateStack && plan.AvailableIpAddresses < requiredFreeIps {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("subnet '%s' has no free IP addresses", plan.SubnetId))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
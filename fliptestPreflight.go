@@ -0,0 +1,221 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// requiredAction is an IAM action the caller needs on
+// a resource for .Test() to succeed.
+type requiredAction struct {
+	Action   string
+	Resource string
+}
+
+// Preflight checks that the caller has the IAM permissions .Test()
+// needs to create, call and delete the stack with the current options
+// by simulating them with iam:SimulatePrincipalPolicy. It returns
+// the denied actions, each as "action on resource (decision)", and an
+// error listing them if there are any. The caller needs
+// sts:GetCallerIdentity and iam:SimulatePrincipalPolicy, plus
+// iam:GetRole when using an assumed role. Only identity policies and
+// permissions boundaries are simulated; SCPs and resource policies
+// may still deny actions.
+func (ft *FlipTester) Preflight() (missing []string, err error) {
+	msg := "checking IAM permissions"
+	ft.logMessage(msg)
+	identity, err := ft.stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, err
+	}
+	principal, err := ft.simulationPrincipal(aws.StringValue(identity.Arn))
+	if err != nil {
+		return nil, err
+	}
+	callerArn, err := arn.Parse(aws.StringValue(identity.Arn))
+	if err != nil {
+		return nil, err
+	}
+	actions := ft.requiredActions(callerArn.Partition, aws.StringValue(identity.Account),
+		aws.StringValue(ft.sess.Config.Region),
+	)
+	// simulate each resource's actions together
+	var resources []string
+	byResource := make(map[string][]string)
+	for _, action := range actions {
+		if _, ok := byResource[action.Resource]; !ok {
+			resources = append(resources, action.Resource)
+		}
+		byResource[action.Resource] = append(byResource[action.Resource], action.Action)
+	}
+	for _, resource := range resources {
+		err = ft.iamSvc.SimulatePrincipalPolicyPages(&iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: aws.String(principal),
+			ActionNames:     aws.StringSlice(byResource[resource]),
+			ResourceArns:    []*string{aws.String(resource)},
+			ContextEntries:  ft.simulationContext(),
+		}, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+			for _, result := range page.EvaluationResults {
+				decision := aws.StringValue(result.EvalDecision)
+				if decision != iam.PolicyEvaluationDecisionTypeAllowed {
+					missing = append(missing, fmt.Sprintf("%s on %s (%s)",
+						aws.StringValue(result.EvalActionName), resource, decision,
+					))
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	ft.MissingPermissions = missing
+	if len(missing) > 0 {
+		for _, m := range missing {
+			ft.logMessage("missing permission: " + m)
+		}
+		err = errors.New("missing IAM permissions: " + strings.Join(missing, "; "))
+		return missing, err
+	}
+	msg = fmt.Sprintf("all %d required actions are allowed", len(actions))
+	ft.logMessage(msg)
+	return nil, nil
+}
+
+// simulationPrincipal returns the ARN of the IAM user or role
+// whose policies apply to the caller. Assumed role sessions are
+// mapped back to their role, which may have a path.
+func (ft *FlipTester) simulationPrincipal(callerArn string) (string, error) {
+	parsed, err := arn.Parse(callerArn)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(parsed.Resource, "user/"):
+		return callerArn, nil
+	case strings.HasPrefix(parsed.Resource, "assumed-role/"):
+		// assumed-role/<name>/<session>
+		roleName := strings.Split(parsed.Resource, "/")[1]
+		response, err := ft.iamSvc.GetRole(&iam.GetRoleInput{
+			RoleName: aws.String(roleName),
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(response.Role.Arn), nil
+	}
+	return "", fmt.Errorf("can't simulate permissions for caller '%s'", callerArn)
+}
+
+// simulationContext returns the condition keys that the stack's
+// requests will carry so that policies requiring them match.
+func (ft *FlipTester) simulationContext() (entries []*iam.ContextEntry) {
+	if ft.permissionsBoundaryArn != "" {
+		entries = append(entries, &iam.ContextEntry{
+			ContextKeyName:   aws.String("iam:PermissionsBoundary"),
+			ContextKeyType:   aws.String(iam.ContextKeyTypeEnumString),
+			ContextKeyValues: []*string{aws.String(ft.permissionsBoundaryArn)},
+		})
+	}
+	return entries
+}
+
+// requiredActions returns the actions .Test() will need with the
+// current options. Resource ARNs are narrowed to the names the
+// stack's resources will get where they're predictable.
+func (ft *FlipTester) requiredActions(partition, account, region string) (actions []*requiredAction) {
+	add := func(resource string, names ...string) {
+		for _, name := range names {
+			actions = append(actions, &requiredAction{Action: name, Resource: resource})
+		}
+	}
+	deleting := !ft.RetainStack
+	stackArn := fmt.Sprintf("arn:%s:cloudformation:%s:%s:stack/%s*/*", partition, region, account, ft.stackPrefix)
+	roleArn := fmt.Sprintf("arn:%s:iam::%s:role%s%s%s*", partition, account,
+		ft.rolePath, ft.roleNamePrefix, ft.stackPrefix,
+	)
+	functionArn := fmt.Sprintf("arn:%s:lambda:%s:%s:function:%s*", partition, region, account, ft.stackPrefix)
+	ruleArn := fmt.Sprintf("arn:%s:events:%s:%s:rule/%s*", partition, region, account, ft.stackPrefix)
+	queueArn := fmt.Sprintf("arn:%s:sqs:%s:%s:%s*", partition, region, account, ft.stackPrefix)
+
+	add(stackArn, "cloudformation:CreateStack", "cloudformation:DescribeStacks",
+		"cloudformation:DescribeStackEvents",
+	)
+	if deleting {
+		add(stackArn, "cloudformation:DeleteStack")
+	}
+	createsRole := ft.executionRoleArn == "" || ft.stackTTLHours > 0
+	if createsRole {
+		add(roleArn, "iam:CreateRole", "iam:GetRole", "iam:PassRole", "iam:AttachRolePolicy", "iam:TagRole")
+	}
+	if createsRole && deleting {
+		add(roleArn, "iam:DeleteRole", "iam:DetachRolePolicy", "iam:ListAttachedRolePolicies",
+			"iam:ListRolePolicies", "iam:ListInstanceProfilesForRole",
+		)
+	}
+	if ft.executionRoleArn != "" {
+		add(ft.executionRoleArn, "iam:PassRole")
+	}
+	add(functionArn, "lambda:CreateFunction", "lambda:GetFunction", "lambda:InvokeFunction",
+		"lambda:TagResource", "lambda:GetFunctionConfiguration",
+	)
+	if deleting {
+		add(functionArn, "lambda:DeleteFunction")
+	}
+	add("*", "ec2:DescribeSecurityGroups", "ec2:DescribeSubnets", "ec2:DescribeVpcs",
+		"ec2:DescribeNetworkInterfaces",
+	)
+	if !ft.excludeGeneratedSecurityGroup {
+		add("*", "ec2:CreateSecurityGroup", "ec2:CreateTags")
+	}
+	if !ft.excludeGeneratedSecurityGroup && deleting {
+		add("*", "ec2:DeleteSecurityGroup")
+	}
+	if ft.stackTTLHours > 0 {
+		add(roleArn, "iam:PutRolePolicy")
+		add(functionArn, "lambda:AddPermission")
+		add(ruleArn, "events:PutRule", "events:PutTargets", "events:DescribeRule", "events:TagResource")
+		if deleting {
+			add(roleArn, "iam:DeleteRolePolicy")
+			add(functionArn, "lambda:RemovePermission")
+			add(ruleArn, "events:DeleteRule", "events:RemoveTargets", "events:ListTargetsByRule")
+			add(functionArn, "lambda:GetPolicy")
+		}
+	}
+	if ft.kmsKeyArn != "" {
+		add(ft.kmsKeyArn, "kms:CreateGrant", "kms:Decrypt", "kms:Encrypt")
+	}
+	if ft.reservedConcurrency != 0 {
+		add(functionArn, "lambda:PutFunctionConcurrency")
+		if deleting {
+			add(functionArn, "lambda:DeleteFunctionConcurrency")
+		}
+	}
+	if ft.async {
+		add(queueArn, "sqs:CreateQueue", "sqs:GetQueueAttributes", "sqs:SetQueueAttributes",
+			"sqs:TagQueue", "sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:ChangeMessageVisibility",
+		)
+		add(functionArn, "lambda:PutFunctionEventInvokeConfig")
+		if ft.executionRoleArn == "" {
+			add(roleArn, "iam:PutRolePolicy")
+		}
+		if deleting {
+			add(queueArn, "sqs:DeleteQueue")
+			add(functionArn, "lambda:DeleteFunctionEventInvokeConfig")
+		}
+		if deleting && ft.executionRoleArn == "" {
+			add(roleArn, "iam:DeleteRolePolicy")
+		}
+	}
+	if ft.reuseStack {
+		// finding a stack to reuse describes every stack
+		add("*", "cloudformation:DescribeStacks")
+	}
+	return actions
+}
@@ -0,0 +1,16 @@
+package fliptest
+
+import "testing"
+
+func TestRequiredActionsForRetainedSelfExpiringStack(t *testing.T) {
+	ft := &FlipTester{RetainStack: true, async: true, stackTTLHours: 2, stackPrefix: "fliptest-"}
+	for _, action := range ft.requiredActions("aws", "123456789012", "us-east-1") {
+		switch action.Action {
+		case "sqs:DeleteQueue", "lambda:DeleteFunctionEventInvokeConfig", "iam:DeleteRolePolicy":
+			// the stack deletes itself as its cleanup role
+			t.Errorf("got %s on %s, want no deletion permissions for a retained stack",
+				action.Action, action.Resource,
+			)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package fliptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// The version of the request and response format that this client
+// speaks. Version 1 is the original bare list of results, which the
+// lambdas of stacks from template versions before 9 return. Version 2
+// added the envelope and version 3, from template version 10, the
+// probe's environment and the "Info" request type. Lambdas answer in
+// the lower of the request's version and their own, and later
+// versions only add fields, so either side can be upgraded first.
+const ProtocolVersion int = 3
+
+// lambdaResponse is the envelope the lambda returns.
+type lambdaResponse struct {
+	ProtocolVersion int
+	RunId           string
+	Batch           int
+	Results         []*TestResult
+	Metadata        *RunMetadata
+}
+
+// RunMetadata describes the lambda invocation that ran
+// a batch of tests.
+type RunMetadata struct {
+	// The protocol version the lambda responded with.
+	// Version 1 responses carry no other metadata.
+	ProtocolVersion int
+
+	RequestId string
+
+	// The lambda's runtime e.g. "python3.9.16".
+	Runtime string
+
+	// How long the lambda took to run the batch.
+	DurationS float64
+
+	// Where the batch ran from. Protocol versions
+	// before 3 don't report it.
+	Probe *ProbeInfo
+}
+
+// parseResponse reads the lambda's response payload. Bare lists
+// of results from older stacks are accepted as protocol version 1.
+// Responses from a newer protocol than this client's are rejected
+// rather than misread.
+func parseResponse(payload []byte) (*lambdaResponse, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '[' {
+		response := &lambdaResponse{
+			ProtocolVersion: 1,
+			Metadata:        &RunMetadata{ProtocolVersion: 1},
+		}
+		err := json.Unmarshal(payload, &response.Results)
+		return response, err
+	}
+	var response lambdaResponse
+	err := json.Unmarshal(payload, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.ProtocolVersion < 2 {
+		err = fmt.Errorf("unrecognized response from lambda: %.200s", payload)
+		return nil, err
+	}
+	if response.ProtocolVersion > ProtocolVersion {
+		err = fmt.Errorf("lambda responded with protocol version %d but this client only understands "+
+			"up to %d; upgrade fliptest", response.ProtocolVersion, ProtocolVersion,
+		)
+		return nil, err
+	}
+	if response.Metadata == nil {
+		response.Metadata = &RunMetadata{}
+	}
+	response.Metadata.ProtocolVersion = response.ProtocolVersion
+	return &response, nil
+}
+
+// noteOldProtocol logs a suggestion to upgrade the stack when
+// any batch was run by a lambda that speaks an older protocol.
+func (ft *FlipTester) noteOldProtocol(metadata []*RunMetadata) {
+	for _, m := range metadata {
+		if m != nil && m.ProtocolVersion < ProtocolVersion {
+			msg := fmt.Sprintf("lambda responded with protocol version %d; upgrade the stack "+
+				"with UpgradeStack or PlanUpgrade for run metadata", m.ProtocolVersion,
+			)
+			ft.logMessage(msg)
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package fliptest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// A reused stack must live at least this much longer
+// than its StackTTLHours expiry to be picked.
+const reuseMinRemainingTTL = 30 * time.Minute
+
+// sharedStackName returns a stack name that is the same for every
+// FlipTester with the same prefix, VPC, subnet, template version
+// and configuration.
+func (ft *FlipTester) sharedStackName() string {
+	h := fnv.New32a()
+	key := ft.vpcId + "/" + ft.subnetId + "/" + ft.templateVersion() + "/" + ft.configHash()
+	if ft.async {
+		key += "/async"
+	}
+	h.Write([]byte(key))
+	return ft.stackPrefix + fmt.Sprintf("%08x", h.Sum32())
+}
+
+// templateVersion returns the version the stack's tags record
+// for the template the FlipTester creates stacks from.
+func (ft *FlipTester) templateVersion() string {
+	if ft.stackTemplateFilename != "" {
+		return "custom"
+	}
+	return TemplateVersion
+}
+
+// configHash returns a hash of the rest of what makes one tester's
+// stack unsuitable for another: a custom template's body and the
+// StackParameters or the default template's security group, role
+// and function options and whether the stack expires. A tester that
+// asks for a StackTTLHours never gets a stack that doesn't expire.
+func (ft *FlipTester) configHash() string {
+	h := fnv.New32a()
+	if ft.stackTemplateFilename != "" {
+		// an unreadable template fails when the stack is created
+		body, _ := ft.getTemplateBody()
+		h.Write([]byte(body))
+	} else {
+		if len(ft.securityGroupIds) > 0 || ft.excludeGeneratedSecurityGroup {
+			groups := append([]string(nil), ft.securityGroupIds...)
+			sort.Strings(groups)
+			fmt.Fprintf(h, "\x00groups=%s/%t", strings.Join(groups, ","), ft.excludeGeneratedSecurityGroup)
+		}
+		for _, param := range append(ft.roleParameters(), ft.functionParameters()...) {
+			fmt.Fprintf(h, "\x00%s=%s", aws.StringValue(param.ParameterKey), aws.StringValue(param.ParameterValue))
+		}
+		if ft.stackTTLHours > 0 {
+			h.Write([]byte("\x00expires"))
+		}
+	}
+	for _, key := range sortedKeys(ft.stackParameters) {
+		fmt.Fprintf(h, "\x00%s=%s", key, ft.stackParameters[key])
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// reuseExistingStack looks for a healthy stack created for the same
+// VPC, subnet, template version and configuration and, if one is
+// found, points the FlipTester at it. nameTaken reports whether the
+// shared stack name is held by an unhealthy stack and so can't be
+// used for a new one.
+func (ft *FlipTester) reuseExistingStack() (reused, nameTaken bool, err error) {
+	msg := "looking for an existing stack to reuse"
+	ft.logMessage(msg)
+	stacks, err := listStacks(ft.cfSvc, ft.stackPrefix, ft.reuseTags())
+	if err != nil {
+		return false, false, err
+	}
+	var pending *StackSummary
+	for _, stack := range stacks {
+		if !stack.ExpiresAt.IsZero() && time.Until(stack.ExpiresAt) < reuseMinRemainingTTL {
+			// about to delete itself
+			nameTaken = nameTaken || stack.StackName == ft.sharedStackName()
+			continue
+		}
+		switch stack.StackStatus {
+		case cloudformation.StackStatusCreateComplete, cloudformation.StackStatusUpdateComplete:
+			msg = fmt.Sprintf("reusing existing stack '%s'", stack.StackName)
+			ft.logMessage(msg)
+			ft.StackName = stack.StackName
+			ft.ExpiresAt = stack.ExpiresAt
+			ft.stackCreated = true
+			return true, false, nil
+		case cloudformation.StackStatusCreateInProgress:
+			pending = stack
+		default:
+			if stack.StackName == ft.sharedStackName() {
+				nameTaken = true
+			}
+		}
+	}
+	if pending == nil {
+		return false, nameTaken, nil
+	}
+	msg = fmt.Sprintf("waiting for stack '%s' that is still being created", pending.StackName)
+	ft.logMessage(msg)
+	ft.StackName = pending.StackName
+	ft.ExpiresAt = pending.ExpiresAt
+	_, err = ft.watchStack(aws.String(pending.StackId), 90)
+	if err != nil {
+		return false, false, err
+	}
+	ft.stackCreated = true
+	return true, false, nil
+}
+
+// reuseTags returns the tags a stack must have to be reused.
+// Asynchronous testers need a stack with a results queue.
+func (ft *FlipTester) reuseTags() map[string]string {
+	tags := map[string]string{
+		tagVpcId:           ft.vpcId,
+		tagSubnetId:        ft.subnetId,
+		tagTemplateVersion: ft.templateVersion(),
+		tagConfigHash:      ft.configHash(),
+	}
+	if ft.async {
+		tags[tagAsyncResults] = "true"
+	}
+	return tags
+}
+
+func isAlreadyExists(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == cloudformation.ErrCodeAlreadyExistsException
+	}
+	return false
+}
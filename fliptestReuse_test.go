@@ -0,0 +1,69 @@
+package fliptest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedStackNameDependsOnConfig(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{"a.yaml": "Resources: {}", "b.yaml": "Resources: {B: {}}"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tester := func(template string, params map[string]string) *FlipTester {
+		return &FlipTester{
+			vpcId:                 "vpc-1",
+			subnetId:              "subnet-1",
+			stackPrefix:           DefaultStackPrefix,
+			stackTemplateFilename: filepath.Join(dir, template),
+			stackParameters:       params,
+		}
+	}
+	a := tester("a.yaml", nil)
+	names := map[string]bool{a.sharedStackName(): true}
+	for _, other := range []*FlipTester{
+		tester("b.yaml", nil),
+		tester("a.yaml", map[string]string{"Size": "1"}),
+		tester("a.yaml", map[string]string{"Size": "2"}),
+	} {
+		if names[other.sharedStackName()] {
+			t.Errorf("%s with %v shares a stack name with another config",
+				other.stackTemplateFilename, other.stackParameters,
+			)
+		}
+		names[other.sharedStackName()] = true
+	}
+	if tester("a.yaml", nil).sharedStackName() != a.sharedStackName() {
+		t.Error("want the same config to share a stack name")
+	}
+}
+
+func TestSharedStackNameDependsOnOptions(t *testing.T) {
+	tester := func(groups []string, memorySize int) *FlipTester {
+		return &FlipTester{
+			vpcId:            "vpc-1",
+			subnetId:         "subnet-1",
+			stackPrefix:      DefaultStackPrefix,
+			rolePath:         defaultRolePath,
+			securityGroupIds: groups,
+			memorySize:       memorySize,
+		}
+	}
+	plain := tester(nil, 0).sharedStackName()
+	withGroups := tester([]string{"sg-1", "sg-2"}, 0).sharedStackName()
+	if withGroups == plain || tester(nil, 1024).sharedStackName() == plain {
+		t.Error("want security groups and lambda settings to change the stack name")
+	}
+	expiring := tester(nil, 0)
+	expiring.stackTTLHours = 12
+	if expiring.sharedStackName() == plain {
+		t.Error("want a StackTTLHours to change the stack name")
+	}
+	if tester([]string{"sg-2", "sg-1"}, 0).sharedStackName() != withGroups {
+		t.Error("want the order of SecurityGroupIds not to matter")
+	}
+}
@@ -0,0 +1,68 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// The path given to roles the default template creates
+// unless FlipTesterInput.RolePath is set.
+const defaultRolePath string = "/cs/"
+
+// The longest IAM role name allowed.
+const maxRoleNameLength int = 64
+
+// setRoleOptions validates the role related inputs and
+// stores them on the FlipTester.
+func (ft *FlipTester) setRoleOptions(input *FlipTesterInput) error {
+	custom := input.ExecutionRoleArn != "" || input.PermissionsBoundaryArn != "" ||
+		input.RolePath != "" || input.RoleNamePrefix != ""
+	if custom && input.StackTemplateFilename != "" {
+		return errors.New("ExecutionRoleArn, PermissionsBoundaryArn, RolePath and RoleNamePrefix " +
+			"are only supported by the default template")
+	}
+	if input.RolePath == "" {
+		input.RolePath = defaultRolePath
+	}
+	if !strings.HasPrefix(input.RolePath, "/") || !strings.HasSuffix(input.RolePath, "/") {
+		return fmt.Errorf("RolePath '%s' must begin and end with '/'", input.RolePath)
+	}
+	if input.RoleNamePrefix != "" {
+		// the longest name is "<prefix><stack name>-cleanup" and
+		// stack names are the StackPrefix and 8 characters
+		longest := len(input.RoleNamePrefix) + len(ft.stackPrefix) + 8 + len("-cleanup")
+		if longest > maxRoleNameLength {
+			return fmt.Errorf("RoleNamePrefix and StackPrefix are too long; role names would be %d characters, "+
+				"the maximum is %d", longest, maxRoleNameLength)
+		}
+	}
+	ft.executionRoleArn = input.ExecutionRoleArn
+	ft.permissionsBoundaryArn = input.PermissionsBoundaryArn
+	ft.rolePath = input.RolePath
+	ft.roleNamePrefix = input.RoleNamePrefix
+	return nil
+}
+
+// roleParameters returns the default template's parameters
+// for the role options that differ from their defaults.
+func (ft *FlipTester) roleParameters() (params []*cloudformation.Parameter) {
+	values := []struct{ key, value, def string }{
+		{"ExecutionRoleArn", ft.executionRoleArn, ""},
+		{"PermissionsBoundaryArn", ft.permissionsBoundaryArn, ""},
+		{"RolePath", ft.rolePath, defaultRolePath},
+		{"RoleNamePrefix", ft.roleNamePrefix, ""},
+	}
+	for _, v := range values {
+		if v.value != "" && v.value != v.def {
+			params = append(params, &cloudformation.Parameter{
+				ParameterKey:   aws.String(v.key),
+				ParameterValue: aws.String(v.value),
+			})
+		}
+	}
+	return params
+}
@@ -0,0 +1,148 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// The destination that is flipped when no other
+// DestinationCidrBlock is provided.
+const defaultDestinationCidrBlock string = "0.0.0.0/0"
+
+// RouteTarget identifies the next hop of a route. Only one
+// of the fields should be set.
+type RouteTarget struct {
+	// An internet gateway or virtual private gateway
+	// e.g. "igw-0123456789abcdef0"
+	GatewayId string
+
+	// A NAT gateway e.g. "nat-0123456789abcdef0"
+	NatGatewayId string
+
+	// A transit gateway e.g. "tgw-0123456789abcdef0"
+	TransitGatewayId string
+
+	// A gateway load balancer or Network Firewall
+	// endpoint e.g. "vpce-0123456789abcdef0"
+	VpcEndpointId string
+
+	// A network interface e.g. that of an appliance
+	// instance "eni-0123456789abcdef0"
+	NetworkInterfaceId string
+
+	// A VPC peering connection e.g. "pcx-0123456789abcdef0"
+	VpcPeeringConnectionId string
+}
+
+// String returns the ID of whichever target is set.
+func (rt *RouteTarget) String() string {
+	for _, id := range []string{
+		rt.GatewayId,
+		rt.NatGatewayId,
+		rt.TransitGatewayId,
+		rt.VpcEndpointId,
+		rt.NetworkInterfaceId,
+		rt.VpcPeeringConnectionId,
+	} {
+		if id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+func (rt *RouteTarget) validate() error {
+	set := 0
+	for _, id := range []string{
+		rt.GatewayId,
+		rt.NatGatewayId,
+		rt.TransitGatewayId,
+		rt.VpcEndpointId,
+		rt.NetworkInterfaceId,
+		rt.VpcPeeringConnectionId,
+	} {
+		if id != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one RouteTarget field must be set")
+	}
+	return nil
+}
+
+// routeTargetFromRoute converts a route as described by
+// DescribeRouteTables into a RouteTarget that can be used
+// to put the route back later.
+func routeTargetFromRoute(route *ec2.Route) *RouteTarget {
+	rt := &RouteTarget{
+		NatGatewayId:           aws.StringValue(route.NatGatewayId),
+		TransitGatewayId:       aws.StringValue(route.TransitGatewayId),
+		NetworkInterfaceId:     aws.StringValue(route.NetworkInterfaceId),
+		VpcPeeringConnectionId: aws.StringValue(route.VpcPeeringConnectionId),
+	}
+	gatewayId := aws.StringValue(route.GatewayId)
+	if strings.HasPrefix(gatewayId, "vpce-") {
+		// endpoints are reported as gateways but
+		// have to be replaced as endpoints
+		rt.VpcEndpointId = gatewayId
+	} else {
+		rt.GatewayId = gatewayId
+	}
+	return rt
+}
+
+func (rt *RouteTarget) replaceRouteInput(routeTableId, cidr string) *ec2.ReplaceRouteInput {
+	input := &ec2.ReplaceRouteInput{
+		RouteTableId:         aws.String(routeTableId),
+		DestinationCidrBlock: aws.String(cidr),
+	}
+	switch {
+	case rt.GatewayId != "":
+		input.GatewayId = aws.String(rt.GatewayId)
+	case rt.NatGatewayId != "":
+		input.NatGatewayId = aws.String(rt.NatGatewayId)
+	case rt.TransitGatewayId != "":
+		input.TransitGatewayId = aws.String(rt.TransitGatewayId)
+	case rt.VpcEndpointId != "":
+		input.VpcEndpointId = aws.String(rt.VpcEndpointId)
+	case rt.NetworkInterfaceId != "":
+		input.NetworkInterfaceId = aws.String(rt.NetworkInterfaceId)
+	case rt.VpcPeeringConnectionId != "":
+		input.VpcPeeringConnectionId = aws.String(rt.VpcPeeringConnectionId)
+	}
+	return input
+}
+
+// getRoute looks up the route for cidr in the given route table
+// and returns it along with the route table itself.
+func getRoute(svc ec2iface.EC2API, routeTableId, cidr string) (*ec2.Route, *ec2.RouteTable, error) {
+	response, err := svc.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+		RouteTableIds: []*string{aws.String(routeTableId)},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(response.RouteTables) < 1 {
+		return nil, nil, fmt.Errorf("could not find route table '%s'", routeTableId)
+	}
+	table := response.RouteTables[0]
+	for _, route := range table.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) == cidr {
+			return route, table, nil
+		}
+	}
+	return nil, table, fmt.Errorf("no route for '%s' in route table '%s'", cidr, routeTableId)
+}
+
+// replaceRoute points the route for cidr in the given route
+// table at target.
+func replaceRoute(svc ec2iface.EC2API, routeTableId, cidr string, target *RouteTarget) error {
+	_, err := svc.ReplaceRoute(target.replaceRouteInput(routeTableId, cidr))
+	return err
+}
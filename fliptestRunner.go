@@ -0,0 +1,248 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Target describes one place for a Runner to test: a VPC in an
+// account and region, reached by assuming a role.
+type Target struct {
+
+	// The label for this target. It is used as the
+	// FlipTester Context in log messages and as the key
+	// of the target's result in the RunnerReport.
+	// Default: "<account>/<region>/<vpc>"
+	Context string
+
+	// The role to assume from the base session in order
+	// to test this target. If empty the base session's
+	// credentials are used.
+	RoleArn string
+
+	// The external ID to provide when assuming RoleArn,
+	// if the role requires one.
+	ExternalId string
+
+	// The region of the VPC. Default: the base
+	// session's region.
+	Region string
+
+	// The VPC to test.
+	VpcId string
+
+	// The subnets to test. If empty every subnet in the
+	// VPC is tested, narrowed by SubnetTags if provided.
+	SubnetIds []string
+
+	// Tags a subnet must have to be tested when
+	// SubnetIds is empty.
+	SubnetTags map[string]string
+}
+
+// label returns the target's Context or a default built
+// from its role's account, region and VPC.
+func (t *Target) label() string {
+	if t.Context != "" {
+		return t.Context
+	}
+	account := "default"
+	if parsed, err := arn.Parse(t.RoleArn); err == nil {
+		account = parsed.AccountID
+	}
+	return fmt.Sprintf("%s/%s/%s", account, t.Region, t.VpcId)
+}
+
+// RunnerInput provides all of the information necessary
+// to create a Runner object.
+type RunnerInput struct {
+
+	// The base AWS session from which each target's
+	// role is assumed. If no session is provided then
+	// one will be created using system defaults.
+	Session *session.Session
+
+	// The targets to test.
+	Targets []*Target
+
+	// Settings shared by every target such as TestUrls,
+	// RetainStack and the sleep times. The Session,
+	// Context, VpcId and subnet fields are replaced
+	// for each target.
+	TesterInput *FlipTesterInput
+
+	// The maximum number of targets to test at the
+	// same time. Each target may itself create up to
+	// TesterInput.MaxParallelStacks stacks at once.
+	// Default: 5
+	MaxConcurrency int
+}
+
+// NewRunner returns an instance of Runner provided a prebuilt
+// RunnerInput object. The .Run() method can then be called to
+// test every target and populate .Report.
+func NewRunner(input *RunnerInput) (r *Runner, err error) {
+	if len(input.Targets) < 1 {
+		err = errors.New("at least one Target is required")
+		return nil, err
+	}
+	if input.Session == nil {
+		input.Session, err = session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if input.TesterInput == nil {
+		input.TesterInput = &FlipTesterInput{}
+	}
+	if input.TesterInput.RunId == "" {
+		// one run ID for every target's stacks
+		input.TesterInput.RunId = newRunId()
+	}
+	if input.MaxConcurrency == 0 {
+		input.MaxConcurrency = 5
+	}
+	r = &Runner{
+		Report: &RunnerReport{
+			Results: make(map[string]*TargetResult),
+		},
+		input: input,
+	}
+	for _, target := range input.Targets {
+		if target.VpcId == "" {
+			err = errors.New("VpcId is a required field on every Target")
+			return nil, err
+		}
+		if target.Region == "" {
+			target.Region = aws.StringValue(input.Session.Config.Region)
+		}
+		label := target.label()
+		if _, ok := r.Report.Results[label]; ok {
+			err = fmt.Errorf("more than one Target has the Context '%s'", label)
+			return nil, err
+		}
+		r.Report.Results[label] = &TargetResult{Target: target}
+	}
+	return r, nil
+}
+
+// Runner tests many targets, each with their own credentials,
+// with a bounded number running at once.
+type Runner struct {
+	// The aggregate results of all targets. Populated
+	// once the .Run() method returns.
+	Report *RunnerReport
+
+	input *RunnerInput
+}
+
+// RunnerReport holds the results of every target keyed by the
+// target's Context.
+type RunnerReport struct {
+	Results map[string]*TargetResult
+
+	// Indicates whether or not the tests passed
+	// for every target.
+	Passed bool
+}
+
+// TargetResult holds the outcome of testing a single target.
+type TargetResult struct {
+	Target *Target
+
+	// The subnet by test results for the target. Nil if
+	// the target failed before any tests could run.
+	Matrix *TestMatrix
+
+	// Any error from testing the target.
+	Error string
+
+	// The log messages from the target's FlipTesters.
+	Log string
+
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// Run tests every target, no more than MaxConcurrency at a time,
+// and populates .Report. An error is returned if any target failed.
+func (r *Runner) Run() (err error) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, r.input.MaxConcurrency)
+	for _, result := range r.Report.Results {
+		wg.Add(1)
+		go func(result *TargetResult) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r.runTarget(result)
+		}(result)
+	}
+	wg.Wait()
+	var failed []string
+	for label, result := range r.Report.Results {
+		if result.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", label, result.Error))
+		}
+	}
+	r.Report.Passed = len(failed) < 1
+	if !r.Report.Passed {
+		sort.Strings(failed)
+		err = errors.New("tests failed for some targets: " + strings.Join(failed, "; "))
+	}
+	return err
+}
+
+// runTarget assumes the target's role and tests its subnets.
+func (r *Runner) runTarget(result *TargetResult) {
+	result.StartTime = time.Now()
+	defer func() {
+		result.EndTime = time.Now()
+	}()
+	target := result.Target
+	testerInput := *r.input.TesterInput
+	testerInput.Session = targetSession(r.input.Session, target)
+	testerInput.Context = target.label()
+	testerInput.VpcId = target.VpcId
+	testerInput.SubnetId = ""
+	testerInput.SubnetIds = target.SubnetIds
+	testerInput.SubnetTags = target.SubnetTags
+	testerInput.AllSubnets = len(target.SubnetIds) < 1
+	mt, err := NewMatrix(&testerInput)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	err = mt.Test()
+	result.Matrix = mt.Matrix
+	result.Log = mt.GetLog()
+	if err != nil {
+		result.Error = err.Error()
+	}
+}
+
+// targetSession returns a copy of the base session in the target's
+// region using the target's role if it has one.
+func targetSession(base *session.Session, target *Target) *session.Session {
+	regional := base.Copy(&aws.Config{Region: aws.String(target.Region)})
+	if target.RoleArn == "" {
+		return regional
+	}
+	creds := stscreds.NewCredentials(regional, target.RoleArn,
+		func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = "fliptest"
+			if target.ExternalId != "" {
+				p.ExternalID = aws.String(target.ExternalId)
+			}
+		})
+	return regional.Copy(&aws.Config{Credentials: creds})
+}
@@ -0,0 +1,82 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The most security groups a lambda can have.
+const maxLambdaSecurityGroups int = 5
+
+// setSecurityGroupOptions validates the security group
+// inputs and stores them on the FlipTester.
+func (ft *FlipTester) setSecurityGroupOptions(input *FlipTesterInput) error {
+	if (len(input.SecurityGroupIds) > 0 || input.ExcludeGeneratedSecurityGroup) && input.StackTemplateFilename != "" {
+		return errors.New("SecurityGroupIds and ExcludeGeneratedSecurityGroup are only supported by the default template")
+	}
+	if input.ExcludeGeneratedSecurityGroup && len(input.SecurityGroupIds) < 1 {
+		return errors.New("SecurityGroupIds are required when ExcludeGeneratedSecurityGroup is set")
+	}
+	count := len(input.SecurityGroupIds)
+	if !input.ExcludeGeneratedSecurityGroup {
+		count++
+	}
+	if count > maxLambdaSecurityGroups {
+		return fmt.Errorf("a lambda can have at most %d security groups including the generated one",
+			maxLambdaSecurityGroups,
+		)
+	}
+	for _, id := range input.SecurityGroupIds {
+		if !strings.HasPrefix(id, "sg-") || strings.Contains(id, ",") {
+			return fmt.Errorf("'%s' is not a security group ID", id)
+		}
+	}
+	ft.securityGroupIds = input.SecurityGroupIds
+	ft.excludeGeneratedSecurityGroup = input.ExcludeGeneratedSecurityGroup
+	return nil
+}
+
+// securityGroupParameters returns the default template's
+// parameters for the security group options that are set.
+func (ft *FlipTester) securityGroupParameters() (params []*cloudformation.Parameter) {
+	if len(ft.securityGroupIds) > 0 {
+		params = append(params, &cloudformation.Parameter{
+			ParameterKey:   aws.String("SecurityGroupIds"),
+			ParameterValue: aws.String(strings.Join(ft.securityGroupIds, ",")),
+		})
+	}
+	if ft.excludeGeneratedSecurityGroup {
+		params = append(params, &cloudformation.Parameter{
+			ParameterKey:   aws.String("CreateSecurityGroup"),
+			ParameterValue: aws.String("false"),
+		})
+	}
+	return params
+}
+
+// planSecurityGroups checks that the security groups to
+// attach exist in the plan's VPC.
+func (ft *FlipTester) planSecurityGroups(plan *TestPlan) {
+	if len(ft.securityGroupIds) < 1 {
+		return
+	}
+	response, err := ft.ec2Svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: aws.StringSlice(ft.securityGroupIds),
+	})
+	if err != nil {
+		plan.Problems = append(plan.Problems, fmt.Sprintf("could not describe security groups: %s", err.Error()))
+		return
+	}
+	for _, group := range response.SecurityGroups {
+		if aws.StringValue(group.VpcId) != plan.VpcId {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("security group '%s' belongs to '%s' not '%s'",
+				aws.StringValue(group.GroupId), aws.StringValue(group.VpcId), plan.VpcId,
+			))
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package fliptest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// The tag the template puts on a self-expiring stack's
+// cleanup role so the role can be traced to its stack.
+const tagCleanupStackId string = "fliptest:stack-id"
+
+// The stack statuses that Sweep deletes regardless of age
+// unless other Statuses are provided.
+var DefaultSweepStatuses = []string{
+	cloudformation.StackStatusCreateFailed,
+	cloudformation.StackStatusRollbackComplete,
+	cloudformation.StackStatusDeleteFailed,
+}
+
+// SweepInput provides all of the information necessary
+// to clean up stacks with Sweep.
+type SweepInput struct {
+
+	// The AWS session to use. Stacks are swept in the
+	// session's region. If no session is provided then
+	// one will be created using system defaults.
+	Session *session.Session
+
+	// Only stacks whose names start with this prefix are
+	// swept. If neither StackPrefix nor Tags are provided
+	// then DefaultStackPrefix is used.
+	StackPrefix string
+
+	// Only stacks that have all of these tags are swept.
+	// An empty value matches any value for that key.
+	Tags map[string]string
+
+	// Stacks created longer ago than this are deleted
+	// whatever their status. Zero disables age based
+	// deletion.
+	MaxAge time.Duration
+
+	// Stacks in any of these statuses are deleted
+	// whatever their age.
+	// Default: DefaultSweepStatuses
+	Statuses []string
+
+	// Whether or not to only report which stacks would
+	// be deleted without deleting them.
+	DryRun bool
+
+	// The maximum number of stacks to delete at the
+	// same time.
+	// Default: 5
+	MaxConcurrency int
+
+	// Whether or not to block until each stack is fully
+	// deleted, retrying failed deletions and recording
+	// the resources that blocked them.
+	WaitForDelete bool
+
+	// How many times to retry a failed stack deletion
+	// when WaitForDelete is set.
+	// Default: 3
+	DeleteRetries int
+
+	// The path that self-expiring stacks' cleanup roles
+	// were created under. The roles outlive their stacks
+	// and are deleted once the stack is gone.
+	// Default: "/cs/"
+	RolePath string
+
+	// Called with problems that don't stop the sweep,
+	// such as cleanup roles that couldn't be checked.
+	// Default: the messages are discarded
+	Log func(msg string)
+}
+
+// SweptStack describes a stack that Sweep deleted or, in a
+// dry run, would have deleted.
+type SweptStack struct {
+	Stack *StackSummary
+
+	// Why the stack was chosen e.g. its status or age.
+	Reason string
+
+	// Whether or not the stack was deleted. Always
+	// false in a dry run.
+	Deleted bool
+
+	// Any error from deleting the stack.
+	Error string
+
+	// Resources that prevented the stack from being
+	// deleted when WaitForDelete was set, if any.
+	BlockingResources []*BlockingResource
+
+	// The name of the stack's leftover cleanup role when
+	// that's what was swept. The stack itself is already
+	// deleted.
+	CleanupRole string
+}
+
+// Sweep finds fliptest stacks that are older than MaxAge, past their
+// StackTTLHours expiry or stuck in one of Statuses and deletes them,
+// no more than MaxConcurrency at a time. The cleanup roles left behind
+// by deleted self-expiring stacks are deleted too. In a dry run the
+// stacks and roles are only returned. An error is returned if any of
+// the deletions failed.
+func Sweep(input *SweepInput) (swept []*SweptStack, err error) {
+	if input.Session == nil {
+		input.Session, err = session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if input.Statuses == nil {
+		input.Statuses = DefaultSweepStatuses
+	}
+	if input.MaxConcurrency == 0 {
+		input.MaxConcurrency = 5
+	}
+	if input.DeleteRetries == 0 {
+		input.DeleteRetries = 3
+	}
+	if input.RolePath == "" {
+		input.RolePath = defaultRolePath
+	}
+	if input.Log == nil {
+		input.Log = func(string) {}
+	}
+	prefix := input.StackPrefix
+	if prefix == "" && len(input.Tags) < 1 {
+		prefix = DefaultStackPrefix
+	}
+	cfSvc := cloudformation.New(input.Session)
+	ec2Svc := ec2.New(input.Session)
+	iamSvc := iam.New(input.Session)
+	stacks, err := listStacks(cfSvc, prefix, input.Tags)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, stack := range stacks {
+		if reason := sweepReason(stack, input, now); reason != "" {
+			swept = append(swept, &SweptStack{
+				Stack:  stack,
+				Reason: reason,
+			})
+		}
+	}
+	swept = append(swept, orphanedCleanupRoles(iamSvc, cfSvc, prefix, input)...)
+	if input.DryRun {
+		return swept, nil
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, input.MaxConcurrency)
+	for _, s := range swept {
+		wg.Add(1)
+		go func(s *SweptStack) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			var err error
+			if s.CleanupRole != "" {
+				err = deleteRole(iamSvc, s.CleanupRole)
+			} else if input.WaitForDelete {
+				s.BlockingResources, err = deleteStackAndWait(cfSvc, ec2Svc,
+					s.Stack.StackId, input.DeleteRetries, func(string) {},
+				)
+			} else {
+				_, err = cfSvc.DeleteStack(&cloudformation.DeleteStackInput{
+					StackName: aws.String(s.Stack.StackId),
+				})
+			}
+			if err != nil {
+				s.Error = err.Error()
+			} else {
+				s.Deleted = true
+			}
+		}(s)
+	}
+	wg.Wait()
+	var failed []string
+	for _, s := range swept {
+		if s.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", s.Stack.StackName, s.Error))
+		}
+	}
+	if len(failed) > 0 {
+		err = errors.New("could not delete some stacks: " + strings.Join(failed, "; "))
+	}
+	return swept, err
+}
+
+// sweepReason returns why the stack should be swept or an
+// empty string if it shouldn't be.
+func sweepReason(stack *StackSummary, input *SweepInput, now time.Time) string {
+	if stack.StackStatus == cloudformation.StackStatusDeleteInProgress {
+		return ""
+	}
+	for _, status := range input.Statuses {
+		if stack.StackStatus == status {
+			return "status " + status
+		}
+	}
+	if !stack.ExpiresAt.IsZero() && now.After(stack.ExpiresAt) {
+		// the stack should have deleted itself by now
+		return "expired at " + stack.ExpiresAt.Format(time.RFC3339)
+	}
+	if input.MaxAge > 0 {
+		age := now.Sub(stack.CreationTime)
+		if age > input.MaxAge {
+			return fmt.Sprintf("age %s exceeds %s", age.Round(time.Minute), input.MaxAge)
+		}
+	}
+	return ""
+}
+
+// orphanedCleanupRoles finds the cleanup roles under RolePath whose
+// self-expiring stacks have been deleted and that match the sweep's
+// StackPrefix and Tags. Roles that can't be checked are logged and
+// left alone so that they don't stop the stacks being swept.
+func orphanedCleanupRoles(iamSvc iamiface.IAMAPI, cfSvc cloudformationiface.CloudFormationAPI,
+	prefix string, input *SweepInput) (swept []*SweptStack) {
+	var names []string
+	err := iamSvc.ListRolesPages(&iam.ListRolesInput{
+		PathPrefix: aws.String(input.RolePath),
+	}, func(page *iam.ListRolesOutput, lastPage bool) bool {
+		for _, role := range page.Roles {
+			// named with or without a RoleNamePrefix
+			name := aws.StringValue(role.RoleName)
+			if strings.Contains(name, "-cleanup") || strings.Contains(name, "-CleanupRole-") {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		input.Log("couldn't list cleanup roles: " + err.Error())
+		return nil
+	}
+	for _, name := range names {
+		tags, err := iamSvc.ListRoleTags(&iam.ListRoleTagsInput{
+			RoleName: aws.String(name),
+		})
+		if err != nil {
+			input.Log(fmt.Sprintf("couldn't check cleanup role '%s': %s", name, err.Error()))
+			continue
+		}
+		stackId := ""
+		for _, tag := range tags.Tags {
+			if aws.StringValue(tag.Key) == tagCleanupStackId {
+				stackId = aws.StringValue(tag.Value)
+			}
+		}
+		if stackId == "" {
+			continue
+		}
+		// deleted stacks can still be described by ID
+		response, err := cfSvc.DescribeStacks(&cloudformation.DescribeStacksInput{
+			StackName: aws.String(stackId),
+		})
+		if isNotExist(err) {
+			// deleted too long ago to be described, so only
+			// the name the ID records can be matched
+			stackName := stackNameFromId(stackId)
+			if len(input.Tags) > 0 || stackName == "" || !strings.HasPrefix(stackName, prefix) {
+				continue
+			}
+			swept = append(swept, &SweptStack{
+				Stack:       &StackSummary{StackName: stackName, StackId: stackId},
+				Reason:      "orphaned cleanup role " + name,
+				CleanupRole: name,
+			})
+			continue
+		}
+		if err != nil {
+			input.Log(fmt.Sprintf("couldn't check cleanup role '%s': %s", name, err.Error()))
+			continue
+		}
+		if len(response.Stacks) < 1 {
+			continue
+		}
+		stack := response.Stacks[0]
+		if aws.StringValue(stack.StackStatus) != cloudformation.StackStatusDeleteComplete ||
+			!strings.HasPrefix(aws.StringValue(stack.StackName), prefix) || !stackHasTags(stack, input.Tags) {
+			continue
+		}
+		swept = append(swept, &SweptStack{
+			Stack:       summarizeStack(stack),
+			Reason:      "orphaned cleanup role " + name,
+			CleanupRole: name,
+		})
+	}
+	return swept
+}
+
+// stackNameFromId returns the name in a stack ID of the form
+// arn:aws:cloudformation:region:account:stack/name/uuid.
+func stackNameFromId(stackId string) string {
+	parts := strings.Split(stackId, "/")
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// isNotExist reports whether err is Cloudformation saying
+// that a stack doesn't exist.
+func isNotExist(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "does not exist")
+	}
+	return false
+}
+
+// deleteRole removes a role's inline and attached
+// policies and then the role itself.
+func deleteRole(svc iamiface.IAMAPI, name string) error {
+	policies, err := svc.ListRolePolicies(&iam.ListRolePoliciesInput{
+		RoleName: aws.String(name),
+	})
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies.PolicyNames {
+		_, err = svc.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
+			RoleName:   aws.String(name),
+			PolicyName: policy,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	attached, err := svc.ListAttachedRolePolicies(&iam.ListAttachedRolePoliciesInput{
+		RoleName: aws.String(name),
+	})
+	if err != nil {
+		return err
+	}
+	for _, policy := range attached.AttachedPolicies {
+		_, err = svc.DetachRolePolicy(&iam.DetachRolePolicyInput{
+			RoleName:  aws.String(name),
+			PolicyArn: policy.PolicyArn,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = svc.DeleteRole(&iam.DeleteRoleInput{
+		RoleName: aws.String(name),
+	})
+	return err
+}
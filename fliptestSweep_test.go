@@ -0,0 +1,167 @@
+package fliptest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+// fakeIAM stands in for the IAM API with a set of roles, each
+// with tags, one inline policy and one attached policy. It
+// records the calls that delete things.
+type fakeIAM struct {
+	iamiface.IAMAPI
+	roles   map[string]map[string]string // tags keyed by role name
+	broken  map[string]bool              // roles whose tags can't be read
+	deleted []string
+}
+
+func (f *fakeIAM) ListRolesPages(input *iam.ListRolesInput, fn func(*iam.ListRolesOutput, bool) bool) error {
+	var roles []*iam.Role
+	for name := range f.roles {
+		roles = append(roles, &iam.Role{RoleName: aws.String(name)})
+	}
+	fn(&iam.ListRolesOutput{Roles: roles}, true)
+	return nil
+}
+
+func (f *fakeIAM) ListRoleTags(input *iam.ListRoleTagsInput) (*iam.ListRoleTagsOutput, error) {
+	if f.broken[*input.RoleName] {
+		return nil, awserr.New("AccessDenied", "not allowed", nil)
+	}
+	var tags []*iam.Tag
+	for key, value := range f.roles[*input.RoleName] {
+		tags = append(tags, &iam.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return &iam.ListRoleTagsOutput{Tags: tags}, nil
+}
+
+func (f *fakeIAM) ListRolePolicies(input *iam.ListRolePoliciesInput) (*iam.ListRolePoliciesOutput, error) {
+	return &iam.ListRolePoliciesOutput{PolicyNames: []*string{aws.String("delete-own-stack")}}, nil
+}
+
+func (f *fakeIAM) DeleteRolePolicy(input *iam.DeleteRolePolicyInput) (*iam.DeleteRolePolicyOutput, error) {
+	f.deleted = append(f.deleted, "policy "+*input.PolicyName)
+	return &iam.DeleteRolePolicyOutput{}, nil
+}
+
+func (f *fakeIAM) ListAttachedRolePolicies(input *iam.ListAttachedRolePoliciesInput) (*iam.ListAttachedRolePoliciesOutput, error) {
+	return &iam.ListAttachedRolePoliciesOutput{AttachedPolicies: []*iam.AttachedPolicy{
+		{PolicyArn: aws.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole")},
+	}}, nil
+}
+
+func (f *fakeIAM) DetachRolePolicy(input *iam.DetachRolePolicyInput) (*iam.DetachRolePolicyOutput, error) {
+	f.deleted = append(f.deleted, "attached "+*input.PolicyArn)
+	return &iam.DetachRolePolicyOutput{}, nil
+}
+
+func (f *fakeIAM) DeleteRole(input *iam.DeleteRoleInput) (*iam.DeleteRoleOutput, error) {
+	f.deleted = append(f.deleted, "role "+*input.RoleName)
+	return &iam.DeleteRoleOutput{}, nil
+}
+
+// fakeStacks stands in for the Cloudformation API with
+// stacks keyed by stack ID and one stack's events, newest
+// first, two to a page. Other stacks don't exist.
+type fakeStacks struct {
+	cloudformationiface.CloudFormationAPI
+	stacks map[string]*cloudformation.Stack
+	events []*cloudformation.StackEvent
+	pages  int
+}
+
+func (f *fakeStacks) DescribeStacks(input *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	stack, ok := f.stacks[*input.StackName]
+	if !ok {
+		return nil, awserr.New("ValidationError", "Stack with id "+*input.StackName+" does not exist", nil)
+	}
+	return &cloudformation.DescribeStacksOutput{
+		Stacks: []*cloudformation.Stack{stack},
+	}, nil
+}
+
+func (f *fakeStacks) DescribeStackEventsPages(input *cloudformation.DescribeStackEventsInput,
+	fn func(*cloudformation.DescribeStackEventsOutput, bool) bool) error {
+	for i := 0; i < len(f.events); i += 2 {
+		end := i + 2
+		if end > len(f.events) {
+			end = len(f.events)
+		}
+		f.pages++
+		if !fn(&cloudformation.DescribeStackEventsOutput{StackEvents: f.events[i:end]}, end == len(f.events)) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestOrphanedCleanupRoles(t *testing.T) {
+	stack := func(name, status string) *cloudformation.Stack {
+		return &cloudformation.Stack{
+			StackName:   aws.String(name),
+			StackId:     aws.String("id-" + name),
+			StackStatus: aws.String(status),
+		}
+	}
+	cfSvc := &fakeStacks{stacks: map[string]*cloudformation.Stack{
+		"id-fliptest-1": stack("fliptest-1", cloudformation.StackStatusDeleteComplete),
+		"id-fliptest-2": stack("fliptest-2", cloudformation.StackStatusCreateComplete),
+		"id-other-3":    stack("other-3", cloudformation.StackStatusDeleteComplete),
+	}}
+	iamSvc := &fakeIAM{roles: map[string]map[string]string{
+		"fliptest-1-CleanupRole-ABC": {tagCleanupStackId: "id-fliptest-1"},
+		"fliptest-2-CleanupRole-DEF": {tagCleanupStackId: "id-fliptest-2"},
+		"app-other-3-cleanup":        {tagCleanupStackId: "id-other-3"},
+		"someone-elses-cleanup":      {},
+		// deleted too long ago to be described
+		"fliptest-4-cleanup-1a2b3c4d": {tagCleanupStackId: "arn:aws:cloudformation:us-east-1:1:stack/fliptest-4/1a2b3c4d"},
+		"fliptest-5-cleanup-5e6f7a8b": {},
+	}, broken: map[string]bool{"fliptest-5-cleanup-5e6f7a8b": true}}
+	var logged []string
+	input := &SweepInput{RolePath: defaultRolePath, Log: func(msg string) { logged = append(logged, msg) }}
+	var roles []string
+	for _, s := range orphanedCleanupRoles(iamSvc, cfSvc, "fliptest", input) {
+		roles = append(roles, s.CleanupRole)
+	}
+	sort.Strings(roles)
+	if got := strings.Join(roles, ","); got != "fliptest-1-CleanupRole-ABC,fliptest-4-cleanup-1a2b3c4d" {
+		t.Fatalf("got roles %s, want only the deleted stacks' roles", got)
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "fliptest-5-cleanup-5e6f7a8b") {
+		t.Errorf("got log %v, want the unreadable role logged", logged)
+	}
+	err := deleteRole(iamSvc, "fliptest-1-CleanupRole-ABC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(iamSvc.deleted, "; ")
+	if !strings.HasSuffix(got, "role fliptest-1-CleanupRole-ABC") || len(iamSvc.deleted) != 3 {
+		t.Errorf("got %s, want both policies removed before the role", got)
+	}
+}
+
+func TestOrphanedCleanupRolesWithoutListAccess(t *testing.T) {
+	var logged []string
+	input := &SweepInput{RolePath: defaultRolePath, Log: func(msg string) { logged = append(logged, msg) }}
+	swept := orphanedCleanupRoles(&deniedIAM{}, &fakeStacks{}, "fliptest", input)
+	if len(swept) > 0 || len(logged) != 1 {
+		t.Errorf("got %d roles and log %v, want none and the error logged", len(swept), logged)
+	}
+}
+
+// deniedIAM refuses to list roles.
+type deniedIAM struct {
+	iamiface.IAMAPI
+}
+
+func (f *deniedIAM) ListRolesPages(input *iam.ListRolesInput, fn func(*iam.ListRolesOutput, bool) bool) error {
+	return awserr.New("AccessDenied", "not allowed", nil)
+}
@@ -11,6 +11,115 @@ Parameters:
   VpcId: 
     Description: The vpc to deploy the lambda into
     Type: String
+  CleanupSchedule:
+    Description: A one time schedule expression at which the stack deletes itself e.g. cron(30 14 18 10 ? 2026). Leave empty to keep the stack until it is deleted.
+    Type: String
+    Default: ""
+  ExecutionRoleArn:
+    Description: The ARN of an existing role for the lambda to use. Leave empty to create one.
+    Type: String
+    Default: ""
+  PermissionsBoundaryArn:
+    Description: The ARN of a managed policy to set as the permissions boundary of created roles.
+    Type: String
+    Default: ""
+  RolePath:
+    Description: The path of created roles.
+    Type: String
+    Default: "/cs/"
+  RoleNamePrefix:
+    Description: A prefix for the names of created roles. Leave empty to let Cloudformation name them.
+    Type: String
+    Default: ""
+  SecurityGroupIds:
+    Description: A comma separated list of existing security groups to attach to the lambda.
+    Type: String
+    Default: ""
+  CreateSecurityGroup:
+    Description: Whether or not to create and attach a security group with allow all egress.
+    Type: String
+    Default: "true"
+    AllowedValues:
+    - "true"
+    - "false"
+  MemorySize:
+    Description: The memory (in MB) of the lambda.
+    Type: Number
+    Default: 128
+  Timeout:
+    Description: The timeout (in seconds) of the lambda.
+    Type: Number
+    Default: 30
+  Architecture:
+    Description: The instruction set architecture of the lambda.
+    Type: String
+    Default: x86_64
+    AllowedValues:
+    - x86_64
+    - arm64
+  ReservedConcurrency:
+    Description: The reserved concurrency of the lambda. Leave empty for none.
+    Type: String
+    Default: ""
+  Environment:
+    Description: A JSON object of extra environment variables that the lambda sets before testing.
+    Type: String
+    Default: "{}"
+  KmsKeyArn:
+    Description: The ARN of a KMS key to encrypt the lambda's environment variables with. Leave empty for the default key.
+    Type: String
+    Default: ""
+  AsyncResults:
+    Description: Whether or not to create a queue that asynchronous invocations deliver their results to.
+    Type: String
+    Default: "false"
+    AllowedValues:
+    - "true"
+    - "false"
+
+Conditions:
+  HasCleanupSchedule:
+    Fn::Not:
+    - Fn::Equals:
+      - Ref: CleanupSchedule
+      - ""
+  CreateExecutionRole:
+    Fn::Equals:
+    - Ref: ExecutionRoleArn
+    - ""
+  HasPermissionsBoundary:
+    Fn::Not:
+    - Fn::Equals:
+      - Ref: PermissionsBoundaryArn
+      - ""
+  HasRoleNamePrefix:
+    Fn::Not:
+    - Fn::Equals:
+      - Ref: RoleNamePrefix
+      - ""
+  HasSecurityGroupIds:
+    Fn::Not:
+    - Fn::Equals:
+      - Ref: SecurityGroupIds
+      - ""
+  HasReservedConcurrency:
+    Fn::Not:
+    - Fn::Equals:
+      - Ref: ReservedConcurrency
+      - ""
+  HasKmsKeyArn:
+    Fn::Not:
+    - Fn::Equals:
+      - Ref: KmsKeyArn
+      - ""
+  HasAsyncResults:
+    Fn::Equals:
+    - Ref: AsyncResults
+    - "true"
+  CreateSecurityGroup:
+    Fn::Equals:
+    - Ref: CreateSecurityGroup
+    - "true"
 
 Resources:
   TestInternetFunction:
@@ -19,14 +128,23 @@ Resources:
       Code:
         ZipFile: |
           import json
+          import os
+          import platform
+          import socket
           import time
           import urllib
           import ssl
+          from concurrent.futures import ThreadPoolExecutor
+
+          PROTOCOL_VERSION = 3
+
+          # extra environment variables e.g. proxy settings
+          os.environ.update(json.loads(os.environ.get("FLIPTEST_ENVIRONMENT") or "{}"))
 
           class UrlTimer:
               def __init__(self,name,url):
                   self.name = name
-                  self.starttime = time.time()
+                  self.starttime = 0
                   self.elapsed = ""
                   self.message = ""
                   self.success = False
@@ -34,6 +152,7 @@ Resources:
                   self.response_code = 0
                   self.dict = {}
               def exec(self):
+                  self.starttime = time.time()
                   try:
                       ctx = ssl.create_default_context()
                       ctx.check_hostname = False
@@ -58,7 +177,27 @@ Resources:
                   self.elapsed = time.time() - self.starttime
                   self.dictify()
                   return json.dumps(self.dict)
+          def probe():
+              # the ENI, timeout and memory are looked up by the client
+              s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+              try:
+                  s.connect(("10.255.255.255", 1))
+                  ip = s.getsockname()[0]
+              except Exception:
+                  ip = ""
+              s.close()
+              try:
+                  resolv = open("/etc/resolv.conf").read()
+              except Exception:
+                  resolv = ""
+              return {
+                  "LocalIp": ip,
+                  "Resolvers": [l.split()[1] for l in resolv.splitlines() if l.startswith("nameserver ")],
+                  "Proxy": {k: v for k, v in os.environ.items() if k.lower() in ["http_proxy", "https_proxy", "no_proxy"]},
+              }
           def handler(event, context):
+                  start = time.time()
+                  info = probe()
                   tests = []
                   total_time = float(0)
                   response = []
@@ -76,30 +215,93 @@ Resources:
                           tests.append(UrlTimer("gopkg","http://gopkg.in"))
                           tests.append(UrlTimer("google","http://www.google.com"))
                   if event["RequestType"] in ["RunAll"]:
+                      # probes run concurrently; each times itself
+                      workers = max(1, event.get("Workers") or 1)
+                      with ThreadPoolExecutor(max_workers=workers) as pool:
+                          for report in pool.map(lambda t: t.exec(), tests):
+                              print(report)
                       for test in tests:
-                          print(test.exec())
                           total_time += test.elapsed
                           response.append(test.dict)
-                  return(response)
+                  # answer in the newest version both sides speak
+                  version = min(event.get("ProtocolVersion") or 1, PROTOCOL_VERSION)
+                  if version < 2:
+                      # older clients expect a bare list
+                      return(response)
+                  return {
+                      "ProtocolVersion": version,
+                      "RunId": event.get("RunId", ""),
+                      "Batch": event.get("Batch", 0),
+                      "Results": response,
+                      "Metadata": {
+                          "RequestId": context.aws_request_id,
+                          "Runtime": "python" + platform.python_version(),
+                          "DurationS": time.time() - start,
+                          "Probe": info,
+                      },
+                  }
 
       Handler: "index.handler"
       Role:
-        Fn::GetAtt:
-        - LambdaExecutionRole
-        - Arn
+        Fn::If:
+        - CreateExecutionRole
+        - Fn::GetAtt:
+          - LambdaExecutionRole
+          - Arn
+        - Ref: ExecutionRoleArn
       Runtime: python3.9
-      Timeout: '30'
+      Timeout:
+        Ref: Timeout
+      MemorySize:
+        Ref: MemorySize
+      Architectures:
+      - Ref: Architecture
+      ReservedConcurrentExecutions:
+        Fn::If:
+        - HasReservedConcurrency
+        - Ref: ReservedConcurrency
+        - Ref: AWS::NoValue
+      KmsKeyArn:
+        Fn::If:
+        - HasKmsKeyArn
+        - Ref: KmsKeyArn
+        - Ref: AWS::NoValue
+      Environment:
+        Variables:
+          FLIPTEST_ENVIRONMENT:
+            Ref: Environment
       VpcConfig:
         SecurityGroupIds:
-          - Ref: SecurityGroup
+          Fn::If:
+          - CreateSecurityGroup
+          - Fn::If:
+            - HasSecurityGroupIds
+            - Fn::Split:
+              - ","
+              - Fn::Sub: "${SecurityGroup},${SecurityGroupIds}"
+            - - Ref: SecurityGroup
+          - Fn::Split:
+            - ","
+            - Ref: SecurityGroupIds
         SubnetIds:
           - Ref: SubnetId
             
   LambdaExecutionRole:
     Type: AWS::IAM::Role
+    Condition: CreateExecutionRole
     Properties:
+      RoleName:
+        Fn::If:
+        - HasRoleNamePrefix
+        - Fn::Sub: "${RoleNamePrefix}${AWS::StackName}-exec"
+        - Ref: AWS::NoValue
+      PermissionsBoundary:
+        Fn::If:
+        - HasPermissionsBoundary
+        - Ref: PermissionsBoundaryArn
+        - Ref: AWS::NoValue
       ManagedPolicyArns:
-      - "arn:aws:iam::aws:policy/service-role/AWSLambdaVPCAccessExecutionRole"
+      - Fn::Sub: "arn:${AWS::Partition}:iam::aws:policy/service-role/AWSLambdaVPCAccessExecutionRole"
       AssumeRolePolicyDocument:
         Version: '2012-10-17'
         Statement:
@@ -109,18 +311,241 @@ Resources:
             - lambda.amazonaws.com
           Action:
           - sts:AssumeRole
-      Path: "/cs/"
+      Path:
+        Ref: RolePath
+      Policies:
+        Fn::If:
+        - HasAsyncResults
+        - - PolicyName: send-results
+            PolicyDocument:
+              Version: '2012-10-17'
+              Statement:
+              - Effect: Allow
+                Action:
+                - sqs:SendMessage
+                Resource:
+                  Fn::GetAtt:
+                  - ResultsQueue
+                  - Arn
+        - Ref: AWS::NoValue
 
   SecurityGroup:
     Type: AWS::EC2::SecurityGroup
+    Condition: CreateSecurityGroup
     Properties:
       GroupDescription: for nat relaunch test internet lambda function 
       VpcId: 
         Ref: VpcId 
+      # Deleting the group fails while the lambda's ENIs are being
+      # released. Depending on the cleanup resources keeps them
+      # around so the cleanup can retry.
+      Tags:
+        Fn::If:
+        - HasCleanupSchedule
+        - - Key: fliptest:cleanup
+            Value:
+              Ref: CleanupPermission
+        - Ref: AWS::NoValue
+
+  # Asynchronous invocations send their results, along with the
+  # event that started them, to this queue.
+  ResultsQueue:
+    Type: AWS::SQS::Queue
+    Condition: HasAsyncResults
+    Properties:
+      MessageRetentionPeriod: 1209600
+
+  AsyncInvokeConfig:
+    Type: AWS::Lambda::EventInvokeConfig
+    Condition: HasAsyncResults
+    Properties:
+      FunctionName:
+        Ref: TestInternetFunction
+      Qualifier: "$LATEST"
+      MaximumRetryAttempts: 0
+      DestinationConfig:
+        OnSuccess:
+          Destination:
+            Fn::GetAtt:
+            - ResultsQueue
+            - Arn
+        OnFailure:
+          Destination:
+            Fn::GetAtt:
+            - ResultsQueue
+            - Arn
+
+  # The stack is deleted using this role's permissions so it can't
+  # delete itself; its inline policy would be removed first. It is
+  # retained instead, tagged with the stack so that Sweep can remove
+  # it later, and only has access to this stack's resources.
+  CleanupRole:
+    Type: AWS::IAM::Role
+    Condition: HasCleanupSchedule
+    DeletionPolicy: Retain
+    Properties:
+      RoleName:
+        Fn::If:
+        - HasRoleNamePrefix
+        # the retained role outlives the stack, so a new stack
+        # with the same name needs a different role name
+        - Fn::Sub:
+          - "${RoleNamePrefix}${AWS::StackName}-cleanup-${StackSuffix}"
+          - StackSuffix:
+              Fn::Select:
+              - 0
+              - Fn::Split:
+                - "-"
+                - Fn::Select:
+                  - 2
+                  - Fn::Split:
+                    - "/"
+                    - Ref: AWS::StackId
+        - Ref: AWS::NoValue
+      PermissionsBoundary:
+        Fn::If:
+        - HasPermissionsBoundary
+        - Ref: PermissionsBoundaryArn
+        - Ref: AWS::NoValue
+      ManagedPolicyArns:
+      - Fn::Sub: "arn:${AWS::Partition}:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"
+      AssumeRolePolicyDocument:
+        Version: '2012-10-17'
+        Statement:
+        - Effect: Allow
+          Principal:
+            Service:
+            - lambda.amazonaws.com
+          Action:
+          - sts:AssumeRole
+      Path:
+        Ref: RolePath
+      Tags:
+      - Key: fliptest:stack-id
+        Value:
+          Ref: AWS::StackId
+      Policies:
+      - PolicyName: delete-own-stack
+        PolicyDocument:
+          Version: '2012-10-17'
+          Statement:
+          - Effect: Allow
+            Action:
+            - cloudformation:DeleteStack
+            - cloudformation:DescribeStacks
+            Resource:
+              Ref: AWS::StackId
+          - Effect: Allow
+            Action:
+            - lambda:DeleteFunction
+            - lambda:DeleteFunctionEventInvokeConfig
+            - lambda:GetFunction
+            - lambda:GetFunctionEventInvokeConfig
+            - lambda:GetPolicy
+            - lambda:RemovePermission
+            Resource:
+              Fn::Sub: "arn:${AWS::Partition}:lambda:${AWS::Region}:${AWS::AccountId}:function:${AWS::StackName}-*"
+          - Effect: Allow
+            Action:
+            - sqs:DeleteQueue
+            - sqs:GetQueueAttributes
+            Resource:
+              Fn::Sub: "arn:${AWS::Partition}:sqs:${AWS::Region}:${AWS::AccountId}:${AWS::StackName}-*"
+          - Effect: Allow
+            Action:
+            - iam:DeleteRole
+            - iam:DeleteRolePolicy
+            - iam:DetachRolePolicy
+            - iam:GetRole
+            - iam:ListAttachedRolePolicies
+            - iam:ListInstanceProfilesForRole
+            - iam:ListRolePolicies
+            Resource:
+              Fn::Sub: "arn:${AWS::Partition}:iam::${AWS::AccountId}:role${RolePath}${RoleNamePrefix}${AWS::StackName}-*"
+          - Effect: Allow
+            Action:
+            - events:DeleteRule
+            - events:DescribeRule
+            - events:ListTargetsByRule
+            - events:PutRule
+            - events:RemoveTargets
+            Resource:
+              Fn::Sub: "arn:${AWS::Partition}:events:${AWS::Region}:${AWS::AccountId}:rule/${AWS::StackName}-*"
+          - Effect: Allow
+            Action:
+            - ec2:DeleteSecurityGroup
+            Resource: "*"
+            Condition:
+              StringEquals:
+                ec2:ResourceTag/aws:cloudformation:stack-id:
+                  Ref: AWS::StackId
+          - Effect: Allow
+            Action:
+            - ec2:DescribeSecurityGroups
+            - ec2:DescribeNetworkInterfaces
+            Resource: "*"
+
+  CleanupFunction:
+    Type: AWS::Lambda::Function
+    Condition: HasCleanupSchedule
+    Properties:
+      Code:
+        ZipFile: |
+          import os
+          import boto3
+
+          def handler(event, context):
+              # keep firing hourly so a failed deletion e.g. while ENIs
+              # are released is retried until this rule is deleted too
+              rule = event["resources"][0].split("/")[-1]
+              boto3.client("events").put_rule(Name=rule, ScheduleExpression="rate(1 hour)")
+              boto3.client("cloudformation").delete_stack(StackName=os.environ["STACK_ID"])
+      Handler: "index.handler"
+      Role:
+        Fn::GetAtt:
+        - CleanupRole
+        - Arn
+      Runtime: python3.9
+      Timeout: '30'
+      Environment:
+        Variables:
+          STACK_ID:
+            Ref: AWS::StackId
+
+  CleanupRule:
+    Type: AWS::Events::Rule
+    Condition: HasCleanupSchedule
+    Properties:
+      Description: Deletes the fliptest stack once it expires
+      ScheduleExpression:
+        Ref: CleanupSchedule
+      Targets:
+      - Id: cleanup
+        Arn:
+          Fn::GetAtt:
+          - CleanupFunction
+          - Arn
+
+  CleanupPermission:
+    Type: AWS::Lambda::Permission
+    Condition: HasCleanupSchedule
+    Properties:
+      FunctionName:
+        Ref: CleanupFunction
+      Action: lambda:InvokeFunction
+      Principal: events.amazonaws.com
+      SourceArn:
+        Fn::GetAtt:
+        - CleanupRule
+        - Arn
 
 Outputs:
   FunctionName:
     Description: The name of the lambda function that was created
     Value: !Ref TestInternetFunction
+  ResultsQueueUrl:
+    Description: The URL of the queue that asynchronous results are delivered to
+    Condition: HasAsyncResults
+    Value: !Ref ResultsQueue
 ...
 `
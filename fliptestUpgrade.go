@@ -0,0 +1,347 @@
+package fliptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// StackUpgrade describes a change set that will bring an existing
+// stack up to the current template. It is returned by PlanUpgrade so
+// the changes can be reviewed before ExecuteUpgrade is called.
+type StackUpgrade struct {
+	StackName     string
+	ChangeSetName string
+	ChangeSetId   string
+
+	// The template version the stack is on and the
+	// version it will be on after the upgrade.
+	FromVersion string
+	ToVersion   string
+
+	// The resource changes CloudFormation will make.
+	Changes []*StackChange
+
+	// A line diff from the stack's current template
+	// to the new template.
+	TemplateDiff string
+}
+
+// StackChange is a single resource change in a StackUpgrade.
+type StackChange struct {
+	Action            string
+	LogicalResourceId string
+	ResourceType      string
+
+	// Whether the resource will be replaced: "True",
+	// "False" or "Conditional".
+	Replacement string
+
+	// Which parts of the resource change e.g.
+	// "Properties" or "Tags".
+	Scope []string
+}
+
+func (sc *StackChange) String() string {
+	msg := fmt.Sprintf("%s %s (%s)", sc.Action, sc.LogicalResourceId, sc.ResourceType)
+	if sc.Replacement != "" {
+		msg += fmt.Sprintf(" replacement=%s", sc.Replacement)
+	}
+	if len(sc.Scope) > 0 {
+		msg += fmt.Sprintf(" scope=%s", strings.Join(sc.Scope, ","))
+	}
+	return msg
+}
+
+// String returns a readable summary of the upgrade including
+// the resource changes and the template diff.
+func (su *StackUpgrade) String() string {
+	lines := []string{
+		fmt.Sprintf("upgrade of stack '%s' from template version '%s' to '%s'",
+			su.StackName, su.FromVersion, su.ToVersion),
+	}
+	for _, change := range su.Changes {
+		lines = append(lines, "  "+change.String())
+	}
+	if su.TemplateDiff != "" {
+		lines = append(lines, su.TemplateDiff)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CheckStackVersion looks up which template version the stack was
+// created or last upgraded from and reports whether it is older than
+// TemplateVersion. The version comes from the stack's tags; stacks
+// created before templates were versioned have their template
+// compared with the current one instead. Stacks created from a
+// StackTemplateFilename are never reported as outdated.
+func (ft *FlipTester) CheckStackVersion() (version string, outdated bool, err error) {
+	response, err := ft.cfSvc.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: &ft.StackName,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if len(response.Stacks) < 1 {
+		err = errors.New("could not find stack with provided StackName")
+		return "", false, err
+	}
+	version = stackTag(response.Stacks[0], tagTemplateVersion)
+	switch version {
+	case "custom":
+		outdated = false
+	case "":
+		// predates versioning so compare the templates
+		current, err := ft.currentTemplateBody()
+		if err != nil {
+			return "", false, err
+		}
+		outdated = strings.TrimSpace(current) != strings.TrimSpace(defaultTemplate)
+	default:
+		outdated = version != TemplateVersion
+	}
+	ft.StackTemplateVersion = version
+	ft.StackOutdated = outdated
+	return version, outdated, nil
+}
+
+// PlanUpgrade creates a change set that updates the stack to the
+// current template, keeping its parameter values and tagging it with
+// the new template version. Nothing is changed until ExecuteUpgrade
+// is called with the returned StackUpgrade; CancelUpgrade discards it.
+// A change set that fails is deleted and its reason returned.
+func (ft *FlipTester) PlanUpgrade() (upgrade *StackUpgrade, err error) {
+	response, err := ft.cfSvc.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: &ft.StackName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Stacks) < 1 {
+		err = errors.New("could not find stack with provided StackName")
+		return nil, err
+	}
+	stack := response.Stacks[0]
+	newBody, err := ft.getTemplateBody()
+	if err != nil {
+		return nil, err
+	}
+	oldBody, err := ft.currentTemplateBody()
+	if err != nil {
+		return nil, err
+	}
+	validated, err := ft.cfSvc.ValidateTemplate(&cloudformation.ValidateTemplateInput{
+		TemplateBody: &newBody,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// carry over every parameter the new template still takes
+	var params []*cloudformation.Parameter
+	for _, newParam := range validated.Parameters {
+		if stackParameter(stack, *newParam.ParameterKey) != "" {
+			params = append(params, &cloudformation.Parameter{
+				ParameterKey:     newParam.ParameterKey,
+				UsePreviousValue: aws.Bool(true),
+			})
+		}
+	}
+	upgrade = &StackUpgrade{
+		StackName:     aws.StringValue(stack.StackName),
+		ChangeSetName: fmt.Sprintf("fliptest-upgrade-%d", time.Now().Unix()),
+		FromVersion:   stackTag(stack, tagTemplateVersion),
+		ToVersion:     ft.templateVersion(),
+		TemplateDiff:  lineDiff(oldBody, newBody),
+	}
+	msg := fmt.Sprintf("creating change set '%s'", upgrade.ChangeSetName)
+	ft.logMessage(msg)
+	created, err := ft.cfSvc.CreateChangeSet(&cloudformation.CreateChangeSetInput{
+		StackName:     stack.StackId,
+		ChangeSetName: &upgrade.ChangeSetName,
+		ChangeSetType: aws.String(cloudformation.ChangeSetTypeUpdate),
+		TemplateBody:  &newBody,
+		Parameters:    params,
+		Tags:          upgradeTags(stack.Tags, upgrade.ToVersion),
+		Capabilities: []*string{
+			aws.String("CAPABILITY_IAM"),
+			aws.String("CAPABILITY_NAMED_IAM"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	upgrade.ChangeSetId = aws.StringValue(created.Id)
+	describeInput := &cloudformation.DescribeChangeSetInput{
+		ChangeSetName: created.Id,
+	}
+	err = ft.cfSvc.WaitUntilChangeSetCreateCompleteWithContext(context.Background(), describeInput,
+		request.WithWaiterDelay(request.ConstantWaiterDelay(5*time.Second)),
+		request.WithWaiterMaxAttempts(60),
+	)
+	described, describeErr := ft.cfSvc.DescribeChangeSet(describeInput)
+	if describeErr != nil {
+		err = describeErr
+	} else if err != nil {
+		err = fmt.Errorf("change set failed: %s", aws.StringValue(described.StatusReason))
+	}
+	if err != nil {
+		// a failed change set can't be executed so don't leave it on the stack
+		cancelErr := ft.CancelUpgrade(upgrade)
+		if cancelErr != nil {
+			msg = fmt.Sprintf("couldn't delete change set '%s': %s", upgrade.ChangeSetName, cancelErr.Error())
+			ft.logMessage(msg)
+		}
+		return nil, err
+	}
+	for _, change := range described.Changes {
+		rc := change.ResourceChange
+		if rc == nil {
+			continue
+		}
+		upgrade.Changes = append(upgrade.Changes, &StackChange{
+			Action:            aws.StringValue(rc.Action),
+			LogicalResourceId: aws.StringValue(rc.LogicalResourceId),
+			ResourceType:      aws.StringValue(rc.ResourceType),
+			Replacement:       aws.StringValue(rc.Replacement),
+			Scope:             aws.StringValueSlice(rc.Scope),
+		})
+	}
+	msg = fmt.Sprintf("planned %d changes", len(upgrade.Changes))
+	ft.logMessage(msg)
+	return upgrade, nil
+}
+
+// ExecuteUpgrade executes a change set created by PlanUpgrade and
+// blocks until the stack update is complete.
+func (ft *FlipTester) ExecuteUpgrade(upgrade *StackUpgrade) (err error) {
+	msg := fmt.Sprintf("executing change set '%s'", upgrade.ChangeSetName)
+	ft.logMessage(msg)
+	_, err = ft.cfSvc.ExecuteChangeSet(&cloudformation.ExecuteChangeSetInput{
+		ChangeSetName: &upgrade.ChangeSetId,
+	})
+	if err != nil {
+		return err
+	}
+	err = ft.cfSvc.WaitUntilStackUpdateCompleteWithContext(context.Background(),
+		&cloudformation.DescribeStacksInput{StackName: &ft.StackName},
+		request.WithWaiterDelay(request.ConstantWaiterDelay(10*time.Second)),
+		request.WithWaiterMaxAttempts(90),
+	)
+	if err != nil {
+		if failure := ft.stackFailure(&ft.StackName); failure != "" {
+			err = fmt.Errorf("stack upgrade failed: %s", failure)
+			ft.logMessage(err.Error())
+		}
+		return err
+	}
+	ft.StackTemplateVersion = upgrade.ToVersion
+	ft.StackOutdated = false
+	msg = "stack upgraded"
+	ft.logMessage(msg)
+	return nil
+}
+
+// CancelUpgrade deletes a change set created by PlanUpgrade
+// without executing it.
+func (ft *FlipTester) CancelUpgrade(upgrade *StackUpgrade) (err error) {
+	_, err = ft.cfSvc.DeleteChangeSet(&cloudformation.DeleteChangeSetInput{
+		ChangeSetName: &upgrade.ChangeSetId,
+	})
+	return err
+}
+
+// upgradeIfOutdated checks a resumed stack's template version and,
+// if it's outdated, either logs a warning or upgrades it when
+// UpgradeStack was set.
+func (ft *FlipTester) upgradeIfOutdated() (err error) {
+	version, outdated, err := ft.CheckStackVersion()
+	if err != nil || !outdated {
+		return err
+	}
+	msg := fmt.Sprintf("stack template version '%s' is older than '%s'", version, TemplateVersion)
+	ft.logMessage(msg)
+	if !ft.upgradeStack {
+		msg = "not upgrading stack; set UpgradeStack or use PlanUpgrade to upgrade it"
+		ft.logMessage(msg)
+		return nil
+	}
+	upgrade, err := ft.PlanUpgrade()
+	if err != nil {
+		return err
+	}
+	ft.logMessage(upgrade.String())
+	return ft.ExecuteUpgrade(upgrade)
+}
+
+func (ft *FlipTester) currentTemplateBody() (string, error) {
+	response, err := ft.cfSvc.GetTemplate(&cloudformation.GetTemplateInput{
+		StackName:     &ft.StackName,
+		TemplateStage: aws.String(cloudformation.TemplateStageOriginal),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(response.TemplateBody), nil
+}
+
+// upgradeTags returns the stack's tags with the template
+// version replaced.
+func upgradeTags(tags []*cloudformation.Tag, version string) []*cloudformation.Tag {
+	upgraded := []*cloudformation.Tag{
+		{
+			Key:   aws.String(tagTemplateVersion),
+			Value: aws.String(version),
+		},
+	}
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) != tagTemplateVersion {
+			upgraded = append(upgraded, tag)
+		}
+	}
+	return upgraded
+}
+
+// lineDiff returns the lines that differ between a and b prefixed
+// with "-" or "+", with unchanged lines left out.
+func lineDiff(a, b string) string {
+	aLines := strings.Split(strings.TrimSpace(a), "\n")
+	bLines := strings.Split(strings.TrimSpace(b), "\n")
+	// longest common subsequence table
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			i++
+			j++
+		case j < len(bLines) && (i == len(aLines) || lcs[i][j+1] >= lcs[i+1][j]):
+			diff = append(diff, fmt.Sprintf("+%4d %s", j+1, bLines[j]))
+			j++
+		default:
+			diff = append(diff, fmt.Sprintf("-%4d %s", i+1, aLines[i]))
+			i++
+		}
+	}
+	return strings.Join(diff, "\n")
+}
@@ -0,0 +1,85 @@
+package fliptest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+)
+
+// fakeChangeSets stands in for the Cloudformation API with one
+// stack whose change sets always fail. It records the change
+// sets that are deleted.
+type fakeChangeSets struct {
+	cloudformationiface.CloudFormationAPI
+	deleted []string
+}
+
+func (f *fakeChangeSets) DescribeStacks(input *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	return &cloudformation.DescribeStacksOutput{Stacks: []*cloudformation.Stack{
+		{StackName: input.StackName, StackId: aws.String("id-" + *input.StackName)},
+	}}, nil
+}
+
+func (f *fakeChangeSets) GetTemplate(input *cloudformation.GetTemplateInput) (*cloudformation.GetTemplateOutput, error) {
+	return &cloudformation.GetTemplateOutput{TemplateBody: aws.String("Resources: {}")}, nil
+}
+
+func (f *fakeChangeSets) ValidateTemplate(input *cloudformation.ValidateTemplateInput) (*cloudformation.ValidateTemplateOutput, error) {
+	return &cloudformation.ValidateTemplateOutput{}, nil
+}
+
+func (f *fakeChangeSets) CreateChangeSet(input *cloudformation.CreateChangeSetInput) (*cloudformation.CreateChangeSetOutput, error) {
+	return &cloudformation.CreateChangeSetOutput{Id: aws.String("cs-" + *input.ChangeSetName)}, nil
+}
+
+func (f *fakeChangeSets) WaitUntilChangeSetCreateCompleteWithContext(ctx aws.Context,
+	input *cloudformation.DescribeChangeSetInput, opts ...request.WaiterOption) error {
+	return errors.New("waiter state transitioned to Failure")
+}
+
+func (f *fakeChangeSets) DescribeChangeSet(input *cloudformation.DescribeChangeSetInput) (*cloudformation.DescribeChangeSetOutput, error) {
+	return &cloudformation.DescribeChangeSetOutput{
+		ChangeSetId:  input.ChangeSetName,
+		Status:       aws.String(cloudformation.ChangeSetStatusFailed),
+		StatusReason: aws.String("no updates are to be performed"),
+	}, nil
+}
+
+func (f *fakeChangeSets) DeleteChangeSet(input *cloudformation.DeleteChangeSetInput) (*cloudformation.DeleteChangeSetOutput, error) {
+	f.deleted = append(f.deleted, *input.ChangeSetName)
+	return &cloudformation.DeleteChangeSetOutput{}, nil
+}
+
+func TestPlanUpgradeDeletesFailedChangeSet(t *testing.T) {
+	svc := &fakeChangeSets{}
+	ft := &FlipTester{StackName: "fliptest-1", cfSvc: svc}
+	_, err := ft.PlanUpgrade()
+	if err == nil || !strings.Contains(err.Error(), "no updates") {
+		t.Errorf("got error %v, want the change set's reason", err)
+	}
+	if len(svc.deleted) != 1 || !strings.HasPrefix(svc.deleted[0], "cs-fliptest-upgrade-") {
+		t.Errorf("got deleted change sets %v, want the failed one", svc.deleted)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, want string
+	}{
+		{"a\nb\nc", "a\nb\nc", ""},
+		{"a\nb\nc", "a\nc", "-   2 b"},
+		{"a\nc", "a\nb\nc", "+   2 b"},
+		{"a\nb\nc", "a\nx\nc", "+   2 x\n-   2 b"},
+		{"x", "y", "+   1 y\n-   1 x"},
+		{"a\nb\n", "a\nb", ""},
+	} {
+		if got := lineDiff(tc.a, tc.b); got != tc.want {
+			t.Errorf("lineDiff(%q, %q) = %q, want %q", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package fliptest
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+func TestStackFailureOnlyReportsLatestOperation(t *testing.T) {
+	event := func(id, resourceType, status, reason string) *cloudformation.StackEvent {
+		return &cloudformation.StackEvent{
+			LogicalResourceId:    aws.String(id),
+			ResourceType:         aws.String(resourceType),
+			ResourceStatus:       aws.String(status),
+			ResourceStatusReason: aws.String(reason),
+		}
+	}
+	stack := "AWS::CloudFormation::Stack"
+	svc := &fakeStacks{events: []*cloudformation.StackEvent{
+		// the failed upgrade, newest first
+		event("fliptest-1", stack, "UPDATE_ROLLBACK_IN_PROGRESS", "The following resource(s) failed to update"),
+		event("TestInternetFunction", "AWS::Lambda::Function", "UPDATE_FAILED", "memory too high"),
+		event("fliptest-1", stack, "UPDATE_IN_PROGRESS", "User Initiated"),
+		// an earlier failure the stack recovered from
+		event("fliptest-1", stack, "UPDATE_ROLLBACK_COMPLETE", ""),
+		event("SecurityGroup", "AWS::EC2::SecurityGroup", "UPDATE_FAILED", "old failure"),
+		event("fliptest-1", stack, "UPDATE_IN_PROGRESS", "User Initiated"),
+		event("fliptest-1", stack, "CREATE_IN_PROGRESS", "User Initiated"),
+	}}
+	ft := &FlipTester{cfSvc: svc}
+	got := ft.stackFailure(aws.String("fliptest-1"))
+	want := "TestInternetFunction (AWS::Lambda::Function) UPDATE_FAILED: memory too high"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if svc.pages != 2 {
+		t.Errorf("read %d pages of events, want to stop after 2", svc.pages)
+	}
+}